@@ -21,8 +21,9 @@ type Config struct {
 		Pid             string `json:"pid" yaml:"pid"`           // http basic auth username to send with each event
 	} `json:"api" yaml:"api"`
 	Nodes map[string]struct {
-		Type string `json:"type" yaml:"type"`
-		URI  string `json:"uri" yaml:"uri"`
+		Type  string                 `json:"type" yaml:"type"`
+		URI   string                 `json:"uri" yaml:"uri"`
+		Extra map[string]interface{} `json:"extra" yaml:",inline"` // the node's other options, i.e. ssl or partial_updates
 	}
 }
 
@@ -42,6 +43,9 @@ func LoadConfig(filename string) (config Config, err error) {
 	err = yaml.Unmarshal(ba, &config)
 
 	for k, v := range config.Nodes {
+		for option, value := range v.Extra {
+			v.Extra[option] = fromYAML(value)
+		}
 		config.Nodes[k] = v
 	}
 
@@ -56,3 +60,20 @@ func LoadConfig(filename string) (config Config, err error) {
 
 	return
 }
+
+// fromYAML turns the maps yaml decodes into maps with string keys, so that the options can be encoded as json
+func fromYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprintf("%v", k)] = fromYAML(v)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = fromYAML(t[i])
+		}
+	}
+	return v
+}
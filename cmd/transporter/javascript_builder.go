@@ -191,6 +191,13 @@ func (js *JavascriptBuilder) findNode(in otto.Value) (n Node, err error) {
 	}
 	rawMap["uri"] = val.URI
 
+	// options in the config are defaults, that the application can override
+	for option, value := range val.Extra {
+		if _, ok := rawMap[option]; !ok {
+			rawMap[option] = value
+		}
+	}
+
 	return NewNode(sourceString, val.Type, rawMap)
 }
 
@@ -20,6 +20,7 @@ var (
 		"file":          NewFile,
 		"elasticsearch": NewElasticsearch,
 		"influx":        NewInfluxdb,
+		"rethinkdb":     NewRethinkdb,
 		"transformer":   NewTransformer,
 	}
 )
@@ -0,0 +1,88 @@
+package adaptor
+
+import (
+	"sync"
+	"time"
+)
+
+// a batch buffers a sink's writes, keyed by where they're going, i.e. a namespace, and hands each key's writes to
+// write in one go, in the order they were added.  buffers are written when they reach size, every interval, and
+// whenever flush is called.  write reports its own errors
+type batch struct {
+	size     int
+	interval time.Duration
+
+	write func(key string, items []interface{})
+
+	pending map[string][]interface{} // waiting writes, keyed by where they're going
+	count   int
+
+	done chan struct{}
+	sync.Mutex
+}
+
+func newBatch(size int, interval time.Duration, write func(string, []interface{})) *batch {
+	return &batch{
+		size:     size,
+		interval: interval,
+		write:    write,
+		pending:  make(map[string][]interface{}),
+	}
+}
+
+// start the timer that writes the buffers every interval
+func (b *batch) start() {
+	if b.interval <= 0 {
+		return
+	}
+	b.done = make(chan struct{})
+
+	go func(done chan struct{}) {
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.flush()
+			case <-done:
+				return
+			}
+		}
+	}(b.done)
+}
+
+// stop the timer, and write anything that's left
+func (b *batch) stop() {
+	b.Lock()
+	if b.done != nil {
+		close(b.done)
+		b.done = nil
+	}
+	b.Unlock()
+	b.flush()
+}
+
+// add buffers a write for the key, and writes every buffer once we're holding size writes
+func (b *batch) add(key string, item interface{}) {
+	b.Lock()
+	b.pending[key] = append(b.pending[key], item)
+	b.count++
+	full := b.count >= b.size
+	b.Unlock()
+
+	if full {
+		b.flush()
+	}
+}
+
+// flush writes everything that's buffered
+func (b *batch) flush() {
+	b.Lock()
+	defer b.Unlock()
+
+	for key, items := range b.pending {
+		b.write(key, items)
+	}
+	b.pending = make(map[string][]interface{})
+	b.count = 0
+}
@@ -0,0 +1,36 @@
+package adaptor
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	var writes []string
+	write := func(key string, items []interface{}) {
+		for _, item := range items {
+			writes = append(writes, key+" "+item.(string))
+		}
+	}
+
+	b := newBatch(3, 0, write)
+	b.add("boom.foo", "a")
+	b.add("boom.bar", "b")
+	if len(writes) != 0 {
+		t.Errorf("expected writes to be buffered, got %v", writes)
+	}
+	b.add("boom.foo", "c") // the batch is full here
+
+	sort.Strings(writes)
+	if expected := []string{"boom.bar b", "boom.foo a", "boom.foo c"}; !reflect.DeepEqual(writes, expected) {
+		t.Errorf("expected %v, got %v", expected, writes)
+	}
+
+	writes = nil
+	b.add("boom.foo", "d")
+	b.stop()
+	if expected := []string{"boom.foo d"}; !reflect.DeepEqual(writes, expected) {
+		t.Errorf("expected stop to write what's left, got %v", writes)
+	}
+}
@@ -0,0 +1,391 @@
+package adaptor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/compose/transporter/pkg/events"
+	"github.com/compose/transporter/pkg/message"
+	elastigo "github.com/mattbaird/elastigo/lib"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// the elasticsearch sink's buffer limits, when the config doesn't set them
+const (
+	defaultESBulkActions  = 100
+	defaultESBulkBytes    = 1 << 20
+	defaultESBulkInterval = 1 * time.Second
+)
+
+// an esAction is a write to elasticsearch, i.e. index, update or delete, along with its body
+type esAction struct {
+	op     string // index, update or delete
+	index  string
+	_type  string
+	id     string
+	source interface{} // the document, or the partial document for updates, nil for deletes
+	upsert bool        // whether an update indexes the partial document when there's nothing to update
+
+	routing, parent string // empty when they aren't set
+	version         int64  // the external version of the document, 0 when versioning is off
+
+	msg *message.Msg // the message the action came from
+}
+
+// esBulkConfig is how the sink buffers and sends its writes
+type esBulkConfig struct {
+	maxActions  int           // send once we're holding this many actions
+	maxBytes    int           // or this many bytes
+	interval    time.Duration // and never hold anything for longer than this
+	concurrency int           // how many bulk requests can be in flight at once
+	retries     retryPolicy   // how rejected and failed requests are retried
+}
+
+// newESBulkConfig reads the bulk options from the config, falling back to the defaults
+func newESBulkConfig(conf ElasticsearchConfig) (esBulkConfig, error) {
+	var (
+		c = esBulkConfig{
+			maxActions:  conf.BulkActions,
+			maxBytes:    conf.BulkBytes,
+			interval:    defaultESBulkInterval,
+			concurrency: conf.Concurrency,
+		}
+		err error
+	)
+	if c.maxActions <= 0 {
+		c.maxActions = defaultESBulkActions
+	}
+	if c.maxBytes <= 0 {
+		c.maxBytes = defaultESBulkBytes
+	}
+	if c.concurrency <= 0 {
+		c.concurrency = 1
+	}
+	if conf.FlushInterval != "" {
+		if c.interval, err = time.ParseDuration(conf.FlushInterval); err != nil {
+			return c, fmt.Errorf("malformed flush_interval (%s)", err.Error())
+		}
+		if c.interval <= 0 {
+			return c, fmt.Errorf("malformed flush_interval (%s isn't positive)", conf.FlushInterval)
+		}
+	}
+	c.retries, err = newRetryPolicy(conf.MaxRetries, conf.RetryBackoff)
+	return c, err
+}
+
+// esActionFor maps a message onto an action, sent to the target's index and type.  inserts are indexed,
+// and deletes are deleted by id.  updates replace the whole document, unless partial is set, in which case the
+// changed fields are merged into the document that's already there
+func esActionFor(msg *message.Msg, target esAction, partial bool) esAction {
+	action := target
+	action.op, action.id, action.source, action.msg = "index", msg.IDString(), msg.Document(), msg
+
+	switch msg.Op {
+	case message.Delete:
+		action.op, action.source = "delete", nil
+	case message.Update:
+		if !partial && !modifierOnly(msg) {
+			break
+		}
+		action.op, action.source, action.upsert = "update", partialDoc(msg), !modifierOnly(msg)
+	}
+	return action
+}
+
+// partialDoc is the part of the document an update changed.  fields set by a modifier are nested
+// by their dotted paths, and unset fields are set to null, since a partial update can't remove a field
+func partialDoc(msg *message.Msg) bson.M {
+	doc := bson.M{}
+	for k, v := range msg.Document() {
+		doc[k] = v
+	}
+	if msg.Modifier == nil {
+		return doc
+	}
+	for field, value := range msg.Modifier.Set {
+		setField(doc, strings.Split(field, "."), value)
+	}
+	for _, field := range msg.Modifier.Unset {
+		setField(doc, strings.Split(field, "."), nil)
+	}
+	return doc
+}
+
+// write hands the action to the bulk indexer.  the bulk format elastigo writes has no room for a routing, a parent
+// or an external version, so an action with any of them is handed over with a placeholder id, and send writes them
+// into its metadata line
+func (e *Elasticsearch) write(a esAction) error {
+	id := a.id
+	if a.routing != "" || a.parent != "" || a.version > 0 {
+		id = e.held.hold(a)
+	}
+
+	var err error
+	atomic.AddInt64(&e.pending, 1)
+	switch a.op {
+	case "delete":
+		e.indexer.Delete(a.index, a._type, id, false)
+	case "update":
+		err = e.indexer.UpdateWithPartialDoc(a.index, a._type, id, "", nil, a.source, a.upsert, false)
+	default:
+		err = e.indexer.Index(a.index, a._type, id, "", nil, a.source, false)
+	}
+	if err != nil {
+		atomic.AddInt64(&e.pending, -1)
+	}
+	return err
+}
+
+// esHeld is the metadata the bulk indexer can't write, keyed by the placeholder ids the indexer is handed instead
+// of the actions' ids.  placeholders start with a prefix that's random for each sink, so they can't be taken for
+// a document's id
+type esHeld struct {
+	prefix string
+	next   int64
+	meta   map[string]esMeta
+	sync.Mutex
+}
+
+// esMeta is an action's id, and the parts of its metadata line the bulk indexer can't write
+type esMeta struct {
+	id, routing, parent string
+	version             int64
+}
+
+// hold keeps the action's metadata, and returns the placeholder id it's kept under
+func (h *esHeld) hold(a esAction) string {
+	h.Lock()
+	defer h.Unlock()
+	if h.meta == nil {
+		h.prefix, h.meta = bson.NewObjectId().Hex(), map[string]esMeta{}
+	}
+	h.next++
+	placeholder := fmt.Sprintf("%s-%d", h.prefix, h.next)
+	h.meta[placeholder] = esMeta{id: a.id, routing: a.routing, parent: a.parent, version: a.version}
+	return placeholder
+}
+
+// restore puts the actions' ids back in place of their placeholders, and writes the metadata that was held for
+// them into their metadata lines, i.e. {"index":{"_id":"1","_routing":"u1","_version":5,"_version_type":"external"}}
+func (h *esHeld) restore(actions []esBulkLine) {
+	h.Lock()
+	defer h.Unlock()
+	for i, action := range actions {
+		m, ok := h.meta[action.id]
+		if !ok {
+			continue
+		}
+		delete(h.meta, action.id)
+
+		var line map[string]map[string]interface{}
+		if err := json.Unmarshal(action.meta, &line); err != nil {
+			continue
+		}
+		meta := line[action.op]
+		meta["_id"] = m.id
+		if m.routing != "" {
+			meta["_routing"] = m.routing
+		}
+		if m.parent != "" {
+			meta["_parent"] = m.parent
+		}
+		if m.version > 0 {
+			meta["_version"], meta["_version_type"] = m.version, "external"
+			actions[i].versioned = true
+		}
+		if out, err := json.Marshal(line); err == nil {
+			actions[i].id, actions[i].meta = m.id, out
+		}
+	}
+}
+
+// countConflicts adds to the count of writes elasticsearch rejected for being older than the document it holds
+func (e *Elasticsearch) countConflicts(n int64) {
+	total := atomic.AddInt64(&e.conflicts, n)
+	e.pipe.Event <- events.NewMetricsEvent(time.Now().Unix(), e.path+"/version_conflicts", int(total))
+}
+
+// flush sends everything the bulk indexer is holding, and waits for every request to finish
+func (e *Elasticsearch) flush() {
+	for atomic.LoadInt64(&e.pending) > 0 {
+		e.indexer.Flush()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// send is the bulk indexer's sender.  it posts a buffer of bulk actions, and retries it while the cluster is
+// rejecting it, or can't be reached.  when only some of the actions are rejected, the retry only holds those.
+// the wait between retries grows with each one, and since the indexer only has concurrency senders, the sink
+// stops taking messages once they're all waiting.  an error is only returned when the whole request failed
+func (e *Elasticsearch) send(buf *bytes.Buffer) error {
+	actions := splitBulk(buf.Bytes())
+	defer atomic.AddInt64(&e.pending, -int64(len(actions)))
+
+	e.held.restore(actions)
+	body := joinBulk(actions)
+	for retry := 1; ; retry++ {
+		out, err := e.conn.DoCommand("POST", "/_bulk", nil, bytes.NewBuffer(body))
+		if err != nil && (!retryable(err) || retry > e.bulkConfig.retries.maxRetries) {
+			return err
+		}
+
+		if err == nil {
+			var result esBulkResponse
+			if err := json.Unmarshal(out, &result); err != nil {
+				return fmt.Errorf("malformed bulk response (%s)", err.Error())
+			}
+			if !result.Errors {
+				return nil
+			}
+			if actions = e.report(result, actions, retry <= e.bulkConfig.retries.maxRetries); len(actions) == 0 {
+				return nil
+			}
+			body = joinBulk(actions)
+		}
+		time.Sleep(e.bulkConfig.retries.wait(retry))
+	}
+}
+
+// retryable is true for requests that might work if they're sent again, i.e. the cluster is
+// rejecting requests because it's busy, isn't reachable, or isn't ready
+func retryable(err error) bool {
+	if e, ok := err.(elastigo.ESError); ok {
+		return e.Code == http.StatusTooManyRequests || e.Code == http.StatusBadGateway ||
+			e.Code == http.StatusServiceUnavailable || e.Code == http.StatusGatewayTimeout
+	}
+	return true // the request didn't make it, or we couldn't read the response
+}
+
+// an esBulkLine is one action in a bulk request, its metadata line and its body, which deletes don't have.
+// versioned actions carry an external version
+type esBulkLine struct {
+	op, id     string
+	meta, body []byte
+	versioned  bool
+}
+
+// splitBulk splits the body of a bulk request into its actions
+func splitBulk(buf []byte) []esBulkLine {
+	var (
+		actions []esBulkLine
+		lines   = bytes.Split(bytes.TrimSpace(buf), []byte("\n"))
+	)
+	for i := 0; i < len(lines); i++ {
+		var meta map[string]struct {
+			ID string `json:"_id"`
+		}
+		if err := json.Unmarshal(lines[i], &meta); err != nil {
+			continue
+		}
+		for op, m := range meta {
+			action := esBulkLine{op: op, id: m.ID, meta: lines[i]}
+			if op != "delete" && i+1 < len(lines) {
+				i++
+				action.body = lines[i]
+			}
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// joinBulk builds the body of a bulk request from its actions
+func joinBulk(actions []esBulkLine) []byte {
+	var buf bytes.Buffer
+	for _, action := range actions {
+		buf.Write(action.meta)
+		buf.WriteByte('\n')
+		if action.body != nil {
+			buf.Write(action.body)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// document is the document the action was for, as it was sent.  updates send the part of it that changed,
+// and deletes only send the id
+func (a esBulkLine) document() bson.M {
+	doc := bson.M{}
+	if a.body == nil {
+		doc["_id"] = a.id
+		return doc
+	}
+	json.Unmarshal(a.body, &doc)
+	if partial, ok := doc["doc"].(map[string]interface{}); ok && a.op == "update" {
+		return bson.M(partial)
+	}
+	return doc
+}
+
+// report sends an error down the pipe for each action that failed, along with the document it was for.
+// deleting a document that isn't there isn't a failure, and neither is a versioned write that's older than
+// the document elasticsearch holds, those are counted in the metrics.  when retry is set, actions that were
+// rejected because the cluster is busy aren't reported, they're returned to be sent again
+func (e *Elasticsearch) report(result esBulkResponse, actions []esBulkLine, retry bool) []esBulkLine {
+	var (
+		rejected  []esBulkLine
+		conflicts int64
+	)
+	defer func() {
+		if conflicts > 0 {
+			e.countConflicts(conflicts)
+		}
+	}()
+
+	for i, item := range result.Items {
+		if i >= len(actions) {
+			break
+		}
+		for op, r := range item {
+			if r.Status < 300 || (op == "delete" && r.Status == http.StatusNotFound) {
+				continue
+			}
+			if actions[i].versioned && r.Status == http.StatusConflict {
+				conflicts++
+				continue
+			}
+			if retry && r.Status == http.StatusTooManyRequests {
+				rejected = append(rejected, actions[i])
+				continue
+			}
+			e.pipe.Err <- NewError(ERROR, e.path, fmt.Sprintf("Elasticsearch error (%s %s failed, %d %s)", op, r.ID, r.Status, r.reason()), actions[i].document())
+		}
+	}
+	return rejected
+}
+
+// an esBulkResponse is the part of the bulk api's response we use, whether anything failed, and the result of
+// each action, keyed by the action's op
+type esBulkResponse struct {
+	Errors bool                      `json:"errors"`
+	Items  []map[string]esBulkResult `json:"items"`
+}
+
+type esBulkResult struct {
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"` // a string before elasticsearch 2.0, and an object from then on
+}
+
+// reason describes why the action failed
+func (r esBulkResult) reason() string {
+	var s string
+	if err := json.Unmarshal(r.Error, &s); err == nil {
+		return s
+	}
+	var obj struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(r.Error, &obj); err == nil && obj.Type != "" {
+		return obj.Type + ": " + obj.Reason
+	}
+	return string(r.Error)
+}
@@ -0,0 +1,100 @@
+package adaptor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the suffix of the indices created by an alias swap, i.e. events-20150102150405
+const esAliasSwapLayout = "20060102150405"
+
+// loadMapping reads the settings and mappings that new indices are created with, i.e.
+// {"settings": {"number_of_shards": 1}, "mappings": {"event": {"properties": {...}}}}
+func loadMapping(filename string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't read mapping (%s)", err.Error())
+	}
+	var mapping map[string]interface{}
+	if err := json.Unmarshal(b, &mapping); err != nil {
+		return nil, fmt.Errorf("malformed mapping %s (%s)", filename, err.Error())
+	}
+	return mapping, nil
+}
+
+// managesIndices is true when the sink creates the indices it writes to, rather than leaving
+// elasticsearch to create them with its defaults
+func (e *Elasticsearch) managesIndices() bool {
+	return e.mapping != nil || e.aliasSwap
+}
+
+// setupIndices creates the index the sink writes to, when the sink manages its indices and the index isn't a template.
+// with an alias swap, the index is a fresh one named after the alias and the time, and the alias is pointed at it once the copy is done
+func (e *Elasticsearch) setupIndices() error {
+	if !e.managesIndices() {
+		return nil
+	}
+	e.created = map[string]bool{}
+
+	if e.aliasSwap {
+		e.alias = e.indexTemplate.raw
+		e.index = e.alias + "-" + time.Now().UTC().Format(esAliasSwapLayout)
+		e.indexTemplate, _ = newTemplate(e.index)
+	}
+	if e.indexTemplate.dynamic() { // we don't know the indices until the messages arrive
+		return nil
+	}
+	return e.ensureIndex(e.index)
+}
+
+// ensureIndex creates the index with the mapping, unless it's already there
+func (e *Elasticsearch) ensureIndex(index string) error {
+	if e.created[index] {
+		return nil
+	}
+
+	err := e.call("HEAD", "/"+index, nil, nil)
+	if status, ok := err.(esStatusError); ok && status.status == http.StatusNotFound {
+		err = e.call("PUT", "/"+index, e.mapping, nil)
+		if status, ok := err.(esStatusError); ok && strings.Contains(status.msg, "already_exists") {
+			err = nil // someone else got there first
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("can't create index %s (%s)", index, err.Error())
+	}
+	e.created[index] = true
+	return nil
+}
+
+// swapAlias points the alias at the index the sink has been writing to, and removes it from any other index
+// it pointed at, in one step, so searches against the alias go from the old index to the new one without a gap
+func (e *Elasticsearch) swapAlias() error {
+	var (
+		current map[string]interface{} // the indices the alias points at now
+		actions []interface{}
+	)
+	err := e.call("GET", "/_alias/"+e.alias, nil, &current)
+	if status, ok := err.(esStatusError); ok && status.status == http.StatusNotFound {
+		err = nil // the alias doesn't exist yet
+	}
+	if err != nil {
+		return fmt.Errorf("can't read alias %s (%s)", e.alias, err.Error())
+	}
+
+	for index := range current {
+		if index != e.index {
+			actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": index, "alias": e.alias}})
+		}
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]string{"index": e.index, "alias": e.alias}})
+
+	if err := e.call("POST", "/_aliases", map[string]interface{}{"actions": actions}, nil); err != nil {
+		return fmt.Errorf("can't point alias %s at %s (%s)", e.alias, e.index, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package adaptor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// indexRecorder stands in for a cluster that holds the indices in exists, and the aliases in aliases.
+// it records every request other than a bulk request, and the body of the ones that create an index or change an alias
+type indexRecorder struct {
+	exists  map[string]bool
+	aliases string // the response to GET /_alias/..., a 404 when it's empty
+
+	requests []string
+	bodies   map[string]interface{}
+	sync.Mutex
+}
+
+func (s *indexRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.URL.Path == "/_bulk" {
+		w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+		return
+	}
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+
+	var body interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	index := strings.TrimPrefix(r.URL.Path, "/")
+
+	switch {
+	case r.Method == "HEAD" && !s.exists[index]:
+		http.NotFound(w, r)
+	case r.Method == "PUT":
+		s.exists[index] = true
+		s.bodies[index] = body
+	case r.Method == "GET" && s.aliases == "":
+		http.Error(w, `{"error": "alias [events] missing", "status": 404}`, http.StatusNotFound)
+	case r.Method == "GET":
+		w.Write([]byte(s.aliases))
+	case r.Method == "POST":
+		s.bodies[index] = body
+	}
+}
+
+func writeMapping(t *testing.T, dir string) string {
+	filename := filepath.Join(dir, "mapping.json")
+	mapping := `{"settings": {"number_of_shards": 1}, "mappings": {"event": {"properties": {"name": {"type": "keyword"}}}}}`
+	if err := ioutil.WriteFile(filename, []byte(mapping), 0600); err != nil {
+		t.Fatalf("can't write mapping: %s", err)
+	}
+	return filename
+}
+
+func TestElasticsearchCreatesIndices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transporter-es")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	recorder := &indexRecorder{exists: map[string]bool{"events-a": true}, bodies: map[string]interface{}{}}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	e, errs := newTestElasticsearch(t, server, Config{"index": "events-{doc.tenant}", "type": "event", "mapping": writeMapping(t, dir)})
+	if err := e.setupIndices(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	for _, tenant := range []string{"a", "b", "b"} {
+		e.applyOp(message.NewMsg(message.Insert, bson.M{"_id": 1, "tenant": tenant}))
+	}
+	e.flush()
+
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error %s", err)
+	default:
+	}
+
+	expected := []string{"HEAD /events-a", "HEAD /events-b", "PUT /events-b"}
+	if !reflect.DeepEqual(recorder.requests, expected) {
+		t.Errorf("expected requests %v, got %v", expected, recorder.requests)
+	}
+	settings := recorder.bodies["events-b"].(map[string]interface{})["settings"]
+	if !reflect.DeepEqual(settings, map[string]interface{}{"number_of_shards": float64(1)}) {
+		t.Errorf("expected the index to be created with the mapping's settings, got %v", settings)
+	}
+}
+
+func TestElasticsearchAliasSwap(t *testing.T) {
+	data := []struct {
+		aliases string
+		remove  bool
+	}{
+		{"", false},
+		{`{"events-20150102150405": {"aliases": {"events": {}}}}`, true},
+	}
+
+	for _, v := range data {
+		recorder := &indexRecorder{exists: map[string]bool{}, aliases: v.aliases, bodies: map[string]interface{}{}}
+		server := httptest.NewServer(recorder)
+
+		e, errs := newTestElasticsearch(t, server, Config{"namespace": "events.event", "alias_swap": true})
+		if err := e.setupIndices(); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if !strings.HasPrefix(e.index, "events-") || len(e.index) != len("events-")+len(esAliasSwapLayout) || !recorder.exists[e.index] {
+			t.Errorf("expected a fresh timestamped index to be created, got %s", e.index)
+		}
+
+		e.applyOp(message.NewMsg(message.Insert, bson.M{"_id": 1}))
+		e.applyOp(message.NewMsg(message.Command, bson.M{"flush": true, "copied": true}))
+		server.Close()
+
+		select {
+		case err := <-errs:
+			t.Errorf("unexpected error %s", err)
+		default:
+		}
+
+		actions := []interface{}{
+			map[string]interface{}{"add": map[string]interface{}{"index": e.index, "alias": "events"}},
+		}
+		if v.remove {
+			actions = append([]interface{}{
+				map[string]interface{}{"remove": map[string]interface{}{"index": "events-20150102150405", "alias": "events"}},
+			}, actions...)
+		}
+		if body := recorder.bodies["_aliases"]; !reflect.DeepEqual(body, map[string]interface{}{"actions": actions}) {
+			t.Errorf("expected alias actions %v, got %v", actions, body)
+		}
+	}
+}
+
+func TestElasticsearchAliasSwapRejectsResume(t *testing.T) {
+	recorder := &indexRecorder{exists: map[string]bool{}, bodies: map[string]interface{}{}}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	e, errs := newTestElasticsearch(t, server, Config{"namespace": "events.event", "alias_swap": true})
+	if err := e.setupIndices(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if _, err := e.applyOp(message.NewMsg(message.Command, bson.M{"resumed": true})); err != errAliasSwapResumed {
+		t.Errorf("expected the sink to stop when the source resumes, got %v", err)
+	}
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "alias_swap") {
+			t.Errorf("expected an error for the alias swap, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected an error for the alias swap")
+	}
+	if _, ok := recorder.bodies["_aliases"]; ok {
+		t.Errorf("expected the alias to be left alone")
+	}
+
+	// without an alias to swap, a resume is nothing to the sink
+	e, _ = newTestElasticsearch(t, server, Config{"namespace": "events.event"})
+	if _, err := e.applyOp(message.NewMsg(message.Command, bson.M{"resumed": true})); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+}
+
+func TestElasticsearchIndexOptions(t *testing.T) {
+	if _, err := NewElasticsearch(nil, "es", Config{"uri": "http://localhost:9200", "namespace": "events.event", "mapping": "/missing/mapping.json"}); err == nil {
+		t.Errorf("expected an error for a missing mapping")
+	}
+	if _, err := NewElasticsearch(nil, "es", Config{"uri": "http://localhost:9200", "index": "events-{doc.tenant}", "type": "event", "alias_swap": true}); err == nil {
+		t.Errorf("expected an error swapping the alias of a templated index")
+	}
+}
@@ -0,0 +1,225 @@
+package adaptor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// the source's defaults, when the config doesn't set them
+const (
+	defaultESBatchSize = 500
+	defaultESScroll    = "1m"
+)
+
+// an esSearchResponse is the part of a search or scroll response the source reads
+type esSearchResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []esHit `json:"hits"`
+	} `json:"hits"`
+}
+
+type esHit struct {
+	Index  string          `json:"_index"`
+	Type   string          `json:"_type"`
+	ID     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+}
+
+// Start the adaptor as a source.  the index is read with the scroll api, split into slices that are read
+// concurrently when slices is more than 1.  each document is sent as an insert, with its _index and _type
+// as the message's namespace
+func (e *Elasticsearch) Start() (err error) {
+	defer func() {
+		e.pipe.Stop()
+	}()
+
+	if e.indexTemplate.dynamic() || e.typeTemplate.dynamic() {
+		err = NewError(CRITICAL, e.path, "Elasticsearch error (a source can't read from a templated index or type)", nil)
+		e.pipe.Err <- err
+		return err
+	}
+
+	var (
+		out  = make(chan *message.Msg)
+		errs = make(chan error, e.slices)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < e.slices; i++ {
+		wg.Add(1)
+		go func(slice int) {
+			defer wg.Done()
+			if err := e.scrollSlice(slice, out); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+		close(errs)
+	}()
+
+	// pipe.Send isn't safe to call from more than one goroutine, so everything goes out from here
+	for msg := range out {
+		e.pipe.Send(msg)
+	}
+
+	if err = <-errs; err != nil {
+		e.pipe.Err <- err
+		return err
+	}
+
+	// let the sinks know the copy is done
+	e.pipe.Send(message.NewMsg(message.Command, bson.M{"flush": true, "copied": true}))
+	return nil
+}
+
+// scrollSlice reads one slice of the index onto out
+func (e *Elasticsearch) scrollSlice(slice int, out chan<- *message.Msg) error {
+	search := map[string]interface{}{
+		"size": e.batchSize,
+		"sort": []string{"_doc"},
+	}
+	if e.query != nil {
+		search["query"] = e.query
+	}
+	if e.slices > 1 {
+		search["slice"] = map[string]int{"id": slice, "max": e.slices}
+	}
+
+	var result esSearchResponse
+	if err := e.call("POST", e.searchPath()+"?scroll="+e.scroll, search, &result); err != nil {
+		return NewError(CRITICAL, e.path, fmt.Sprintf("Elasticsearch error (can't search %s %s)", e.getNamespace(), err.Error()), nil)
+	}
+	defer func() {
+		if result.ScrollID != "" {
+			e.call("DELETE", "/_search/scroll", map[string][]string{"scroll_id": {result.ScrollID}}, nil)
+		}
+	}()
+
+	for len(result.Hits.Hits) > 0 {
+		for _, hit := range result.Hits.Hits {
+			if stop := e.pipe.Stopped; stop {
+				return nil
+			}
+			msg, err := hitToMsg(hit)
+			if err != nil {
+				return NewError(CRITICAL, e.path, fmt.Sprintf("Elasticsearch error (can't read document %s %s)", hit.ID, err.Error()), nil)
+			}
+			out <- msg
+		}
+
+		scrollID := result.ScrollID
+		result = esSearchResponse{}
+		if err := e.call("POST", "/_search/scroll", map[string]string{"scroll": e.scroll, "scroll_id": scrollID}, &result); err != nil {
+			result.ScrollID = scrollID
+			return NewError(CRITICAL, e.path, fmt.Sprintf("Elasticsearch error (can't scroll %s %s)", e.getNamespace(), err.Error()), nil)
+		}
+	}
+	return nil
+}
+
+// searchPath is the search endpoint for the index and type.  a type of * or _all searches every type in the index
+func (e *Elasticsearch) searchPath() string {
+	if e._type == "" || e._type == "*" || e._type == "_all" {
+		return "/" + e.index + "/_search"
+	}
+	return "/" + e.index + "/" + e._type + "/_search"
+}
+
+// hitToMsg turns a search hit into an insert, keyed on the hit's _id
+func hitToMsg(hit esHit) (*message.Msg, error) {
+	dec := json.NewDecoder(bytes.NewReader(hit.Source))
+	dec.UseNumber()
+
+	var source map[string]interface{}
+	if err := dec.Decode(&source); err != nil {
+		return nil, err
+	}
+	doc, _ := fromJSON(source).(bson.M)
+	if doc == nil {
+		doc = bson.M{}
+	}
+	doc["_id"] = hit.ID
+
+	msg := message.NewMsg(message.Insert, doc)
+	msg.Namespace = hit.Index + "." + hit.Type
+	return msg, nil
+}
+
+// parseESQuery turns the query option into the query of a search request.  it's either a document, or a string holding one
+func parseESQuery(in interface{}) (interface{}, error) {
+	switch q := in.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if q == "" {
+			return nil, nil
+		}
+		var query map[string]interface{}
+		if err := json.Unmarshal([]byte(q), &query); err != nil {
+			return nil, fmt.Errorf("malformed query (%s)", err.Error())
+		}
+		return query, nil
+	case map[string]interface{}:
+		return q, nil
+	}
+	return nil, fmt.Errorf("malformed query, expected a document (got %T)", in)
+}
+
+// an esStatusError is a request that got an error status back
+type esStatusError struct {
+	status int
+	msg    string
+}
+
+func (e esStatusError) Error() string {
+	return fmt.Sprintf("request failed, %d %s", e.status, e.msg)
+}
+
+// call sends a request to the next host, and decodes the json response into out, if it's given
+func (e *Elasticsearch) call(method, path string, body, out interface{}) error {
+	host := e.hosts[int(atomic.AddUint32(&e.nextHost, 1)-1)%len(e.hosts)]
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(host, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return esStatusError{resp.StatusCode, strings.TrimSpace(string(b))}
+	}
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,202 @@
+package adaptor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// scrollServer stands in for an index, split into slices of pages, and records the searches it's sent
+type scrollServer struct {
+	pages [][]string // each slice's pages, as the hits' json
+
+	searches []map[string]interface{}
+	cleared  []string
+	sync.Mutex
+}
+
+func (s *scrollServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	s.Lock()
+	defer s.Unlock()
+
+	var slice, page int
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/idx/typ/_search" && r.URL.Query().Get("scroll") == "1m":
+		s.searches = append(s.searches, body)
+		if sl, ok := body["slice"].(map[string]interface{}); ok {
+			slice = int(sl["id"].(float64))
+		}
+	case r.Method == "POST" && r.URL.Path == "/_search/scroll":
+		fmt.Sscanf(body["scroll_id"].(string), "s%d-%d", &slice, &page)
+		page++
+	case r.Method == "DELETE" && r.URL.Path == "/_search/scroll":
+		for _, id := range body["scroll_id"].([]interface{}) {
+			s.cleared = append(s.cleared, id.(string))
+		}
+		return
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+		return
+	}
+
+	var hits []string
+	if page < len(s.pages[slice]) {
+		hits = []string{s.pages[slice][page]}
+	}
+	fmt.Fprintf(w, `{"_scroll_id": "s%d-%d", "hits": {"hits": [%s]}}`, slice, page, strings.Join(hits, ","))
+}
+
+func TestElasticsearchSource(t *testing.T) {
+	server := &scrollServer{
+		pages: [][]string{
+			{
+				`{"_index": "idx", "_type": "typ", "_id": "a", "_source": {"count": 1, "score": 1.5, "tags": ["x"]}}`,
+				`{"_index": "idx", "_type": "typ", "_id": "b", "_source": {"nested": {"count": 2}}}`,
+			},
+			{
+				`{"_index": "idx", "_type": "typ", "_id": "c", "_source": {}}`,
+			},
+		},
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	source := pipe.NewPipe(nil, "es")
+	sink := pipe.NewPipe(source, "es/sink")
+	go func() {
+		for err := range source.Err {
+			t.Errorf("unexpected error %v", err)
+		}
+	}()
+
+	a, err := NewElasticsearch(source, "es", Config{"uri": ts.URL, "namespace": "idx.typ", "slices": 2, "batch_size": 10, "query": `{"term": {"tenant": "acme"}}`})
+	if err != nil {
+		t.Fatalf("can't create the adaptor: %s", err)
+	}
+
+	var (
+		msgs = map[string]*message.Msg{}
+		last *message.Msg
+		done = make(chan struct{})
+	)
+	go func() {
+		for msg := range sink.In {
+			if msg.Op != message.Command {
+				msgs[msg.IDString()] = msg
+			}
+			last = msg
+		}
+		close(done)
+	}()
+
+	if err := a.Start(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	close(sink.In)
+	<-done
+
+	if last == nil || last.Op != message.Command || last.Document()["copied"] != true {
+		t.Errorf("expected the copy to finish with a copied command, got %v", last)
+	}
+
+	expected := map[string]bson.M{
+		"a": {"_id": "a", "count": int64(1), "score": 1.5, "tags": []interface{}{"x"}},
+		"b": {"_id": "b", "nested": bson.M{"count": int64(2)}},
+		"c": {"_id": "c"},
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expected %d messages, got %d", len(expected), len(msgs))
+	}
+	for id, doc := range expected {
+		msg := msgs[id]
+		if msg == nil {
+			t.Errorf("expected a message for %s", id)
+			continue
+		}
+		if msg.Op != message.Insert || msg.Namespace != "idx.typ" {
+			t.Errorf("%s: expected an insert into idx.typ, got %s into %s", id, msg.Op, msg.Namespace)
+		}
+		if !reflect.DeepEqual(msg.Document(), doc) {
+			t.Errorf("%s: expected %#v, got %#v", id, doc, msg.Document())
+		}
+	}
+
+	if len(server.searches) != 2 {
+		t.Fatalf("expected a search for each slice, got %d", len(server.searches))
+	}
+	for _, search := range server.searches {
+		if search["size"] != float64(10) {
+			t.Errorf("expected a size of 10, got %v", search["size"])
+		}
+		if !reflect.DeepEqual(search["query"], map[string]interface{}{"term": map[string]interface{}{"tenant": "acme"}}) {
+			t.Errorf("expected the query to be passed through, got %v", search["query"])
+		}
+		if max := search["slice"].(map[string]interface{})["max"]; max != float64(2) {
+			t.Errorf("expected 2 slices, got %v", max)
+		}
+	}
+
+	sort.Strings(server.cleared)
+	if !reflect.DeepEqual(server.cleared, []string{"s0-2", "s1-1"}) {
+		t.Errorf("expected each slice's scroll to be cleared, got %v", server.cleared)
+	}
+}
+
+func TestElasticsearchSourceRejectsTemplates(t *testing.T) {
+	source := pipe.NewPipe(nil, "es")
+	errs := make(chan error, 1)
+	go func() {
+		for err := range source.Err {
+			errs <- err
+		}
+	}()
+
+	a, err := NewElasticsearch(source, "es", Config{"uri": "http://localhost:9200", "index": "events-{doc.tenant}", "type": "event"})
+	if err != nil {
+		t.Fatalf("can't create the adaptor: %s", err)
+	}
+	if err := a.Start(); err == nil {
+		t.Errorf("expected an error reading from a templated index")
+	}
+	<-errs
+}
+
+func TestParseESQuery(t *testing.T) {
+	data := []struct {
+		in  interface{}
+		out interface{}
+		err bool
+	}{
+		{nil, nil, false},
+		{"", nil, false},
+		{`{"match_all": {}}`, map[string]interface{}{"match_all": map[string]interface{}{}}, false},
+		{map[string]interface{}{"match_all": map[string]interface{}{}}, map[string]interface{}{"match_all": map[string]interface{}{}}, false},
+		{`{"match_all"`, nil, true},
+		{`[1, 2]`, nil, true},
+		{float64(1), nil, true},
+	}
+
+	for _, v := range data {
+		out, err := parseESQuery(v.in)
+		if (err != nil) != v.err {
+			t.Errorf("%v: expected error to be %v, got %v", v.in, v.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, v.out) {
+			t.Errorf("%v: expected %v, got %v", v.in, v.out, out)
+		}
+	}
+}
@@ -1,16 +1,34 @@
 package adaptor
 
 import (
+	"compress/bzip2"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/compose/transporter/pkg/message"
 	"github.com/compose/transporter/pkg/pipe"
 )
 
+// the formats a file can hold
+const (
+	fileJSON = "json" // a json document on each line
+	fileCSV  = "csv"
+	fileTSV  = "tsv"
+)
+
+// how a file is compressed
+const (
+	compressNone  = "none"
+	compressGzip  = "gzip"
+	compressBzip2 = "bzip2" // bzip2 files can be read, but not written
+)
+
 // File is an adaptor that can be used as a
 // source / sink for file's on disk, as well as a sink to stdout.
 type File struct {
@@ -18,6 +36,24 @@ type File struct {
 	pipe       *pipe.Pipe
 	path       string
 	filehandle *os.File
+	out        io.Writer // the file, or stdout, through the compressor
+
+	format      string
+	compression string
+
+	// what has to be closed when the adaptor stops, the compressor before the file
+	closers []io.Closer
+	closeMu sync.Mutex
+
+	// csv and tsv options.  columns are the columns that are written, in order, or read when there's no header,
+	// and types are the types of the columns that are read, any other column's type is inferred
+	header    bool
+	delimiter rune
+	quote     string
+	columns   []string
+	types     map[string]string
+
+	wroteHeader bool
 }
 
 // NewFile returns a File Adaptor
@@ -30,11 +66,58 @@ func NewFile(p *pipe.Pipe, path string, extra Config) (StopStartListener, error)
 		return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't configure adaptor (%s)", err.Error()), nil)
 	}
 
-	return &File{
-		uri:  conf.URI,
-		pipe: p,
-		path: path,
-	}, nil
+	d := &File{
+		uri:       conf.URI,
+		pipe:      p,
+		path:      path,
+		out:       os.Stdout,
+		format:    conf.Format,
+		header:    conf.Header == nil || *conf.Header,
+		delimiter: ',',
+		quote:     conf.Quote,
+		columns:   conf.Columns,
+		types:     conf.Types,
+	}
+
+	switch d.format {
+	case "":
+		d.format = fileJSON
+	case fileJSON, fileCSV:
+	case fileTSV:
+		d.delimiter = '\t'
+	default:
+		return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't configure adaptor (unknown format %s, expected json, csv or tsv)", d.format), nil)
+	}
+
+	if conf.Delimiter != "" {
+		if utf8.RuneCountInString(conf.Delimiter) != 1 {
+			return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't configure adaptor (delimiter %q isn't a single character)", conf.Delimiter), nil)
+		}
+		d.delimiter, _ = utf8.DecodeRuneInString(conf.Delimiter)
+		if d.delimiter == '"' || d.delimiter == '\r' || d.delimiter == '\n' {
+			return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't configure adaptor (delimiter %q isn't allowed)", conf.Delimiter), nil)
+		}
+	}
+
+	switch d.quote {
+	case "":
+		d.quote = quoteMinimal
+	case quoteMinimal, quoteAll, quoteNone:
+	default:
+		return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't configure adaptor (unknown quote %s, expected minimal, all or none)", d.quote), nil)
+	}
+
+	if d.compression, err = fileCompression(conf.Compression, d.uri); err != nil {
+		return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't configure adaptor (%s)", err.Error()), nil)
+	}
+
+	for column, kind := range d.types {
+		if _, ok := columnTypes[kind]; !ok {
+			return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't configure adaptor (unknown type %s for column %s)", kind, column), nil)
+		}
+	}
+
+	return d, nil
 }
 
 // Start the file adaptor
@@ -53,36 +136,96 @@ func (d *File) Listen() (err error) {
 		d.Stop()
 	}()
 
+	if err = d.openOutput(); err != nil {
+		d.pipe.Err <- err
+		return err
+	}
+
+	return d.pipe.Listen(d.dumpMessage)
+}
+
+// Stop the adaptor, and close the file, flushing anything the compressor is holding on to
+func (d *File) Stop() error {
+	d.pipe.Stop()
+
+	d.closeMu.Lock()
+	defer d.closeMu.Unlock()
+	var err error
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if cerr := d.closers[i].Close(); cerr != nil && err == nil {
+			err = NewError(ERROR, d.path, fmt.Sprintf("Can't close file (%s)", cerr.Error()), nil)
+			d.pipe.Err <- err
+		}
+	}
+	d.closers = nil
+	return err
+}
+
+// openOutput creates the file, unless we're writing to stdout, and starts the compressor
+func (d *File) openOutput() (err error) {
+	if d.compression == compressBzip2 {
+		return NewError(CRITICAL, d.path, "Can't open output file (bzip2 files can only be read)", nil)
+	}
+
+	d.closeMu.Lock()
+	defer d.closeMu.Unlock()
 	if strings.HasPrefix(d.uri, "file://") {
 		filename := strings.Replace(d.uri, "file://", "", 1)
 		d.filehandle, err = os.Create(filename)
 		if err != nil {
-			d.pipe.Err <- NewError(CRITICAL, d.path, fmt.Sprintf("Can't open output file (%s)", err.Error()), nil)
-			return err
+			return NewError(CRITICAL, d.path, fmt.Sprintf("Can't open output file (%s)", err.Error()), nil)
 		}
+		d.out = d.filehandle
+		d.closers = append(d.closers, d.filehandle)
 	}
 
-	return d.pipe.Listen(d.dumpMessage)
+	if d.compression == compressGzip {
+		gz := gzip.NewWriter(d.out)
+		d.out = gz
+		d.closers = append(d.closers, gz)
+	}
+	return nil
 }
 
-// Stop the adaptor
-func (d *File) Stop() error {
-	d.pipe.Stop()
-	return nil
+// fileCompression is the compression option, or the one the file's extension implies when there isn't one
+func fileCompression(compression, uri string) (string, error) {
+	if compression == "" {
+		switch {
+		case strings.HasSuffix(uri, ".gz"):
+			return compressGzip, nil
+		case strings.HasSuffix(uri, ".bz2"):
+			return compressBzip2, nil
+		case strings.HasSuffix(uri, ".zst"):
+			compression = "zstd"
+		default:
+			return compressNone, nil
+		}
+	}
+
+	switch compression {
+	case compressNone, compressGzip, compressBzip2:
+		return compression, nil
+	case "zstd":
+		return "", fmt.Errorf("zstd isn't supported, decompress the file first")
+	}
+	return "", fmt.Errorf("unknown compression %s, expected none, gzip or bzip2", compression)
 }
 
 /*
  * read each message from the file
  */
 func (d *File) readFile() (err error) {
-	filename := strings.Replace(d.uri, "file://", "", 1)
-	d.filehandle, err = os.Open(filename)
+	r, err := d.openInput()
 	if err != nil {
-		d.pipe.Err <- NewError(CRITICAL, d.path, fmt.Sprintf("Can't open input file (%s)", err.Error()), nil)
+		d.pipe.Err <- err
 		return err
 	}
 
-	decoder := json.NewDecoder(d.filehandle)
+	if d.format != fileJSON {
+		return d.readCSV(r)
+	}
+
+	decoder := json.NewDecoder(r)
 	for {
 		var doc map[string]interface{}
 		if err := decoder.Decode(&doc); err == io.EOF {
@@ -96,24 +239,62 @@ func (d *File) readFile() (err error) {
 	return nil
 }
 
+// openInput opens the file, and decompresses it if it's compressed
+func (d *File) openInput() (io.Reader, error) {
+	d.closeMu.Lock()
+	defer d.closeMu.Unlock()
+
+	filename := strings.Replace(d.uri, "file://", "", 1)
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, NewError(CRITICAL, d.path, fmt.Sprintf("Can't open input file (%s)", err.Error()), nil)
+	}
+	d.filehandle = f
+	d.closers = append(d.closers, f)
+
+	switch d.compression {
+	case compressGzip:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, NewError(CRITICAL, d.path, fmt.Sprintf("Can't open input file (%s)", err.Error()), nil)
+		}
+		d.closers = append(d.closers, gz)
+		return gz, nil
+	case compressBzip2:
+		return bzip2.NewReader(f), nil
+	}
+	return f, nil
+}
+
 /*
  * dump each message to the file
  */
 func (d *File) dumpMessage(msg *message.Msg) (*message.Msg, error) {
+	if msg.Op == message.Command { // there's nothing buffered to flush
+		return msg, nil
+	}
+	if modifierOnly(msg) {
+		d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't write document (%s)", errModifierOnly.Error()), msg.Document())
+		return msg, nil
+	}
+
+	if d.format != fileJSON {
+		if err := d.writeRow(msg.Document()); err != nil {
+			d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't write document (%s)", err.Error()), msg.Document())
+		}
+		return msg, nil
+	}
+
 	jdoc, err := json.Marshal(msg.Document())
 	if err != nil {
 		d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't unmarshal document (%s)", err.Error()), msg.Document())
 		return msg, nil
 	}
 
-	if strings.HasPrefix(d.uri, "stdout://") {
-		fmt.Println(string(jdoc))
-	} else {
-		_, err = fmt.Fprintln(d.filehandle, string(jdoc))
-		if err != nil {
-			d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't unmarshal document (%s)", err.Error()), msg.Document())
-			return msg, nil
-		}
+	_, err = fmt.Fprintln(d.out, string(jdoc))
+	if err != nil {
+		d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't unmarshal document (%s)", err.Error()), msg.Document())
+		return msg, nil
 	}
 
 	return msg, nil
@@ -123,4 +304,21 @@ func (d *File) dumpMessage(msg *message.Msg) (*message.Msg, error) {
 type FileConfig struct {
 	// URI pointing to the resource.  We only recognize file:// and stdout:// currently
 	URI string `json:"uri"`
+
+	// the file's format, json (the default), csv or tsv
+	Format string `json:"format"`
+
+	// Compression is none, gzip or bzip2, which can only be read.  by default it comes from the file's extension, .gz or .bz2
+	Compression string `json:"compression"`
+
+	// csv and tsv options.  the first row is a header unless Header is false, Delimiter is the character between the columns,
+	// and Quote is when values are quoted, minimal (when they need to be), all or none.  Columns are the columns that are written,
+	// in order, all of the first document's fields by default, and the names of the columns that are read when there's no header,
+	// or the columns that are kept when there is one.  Types are the types of the columns that are read, string, int, float, bool,
+	// time or json, any other column's type is inferred
+	Header    *bool             `json:"header"`
+	Delimiter string            `json:"delimiter"`
+	Quote     string            `json:"quote"`
+	Columns   []string          `json:"columns"`
+	Types     map[string]string `json:"types"`
 }
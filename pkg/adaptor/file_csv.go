@@ -0,0 +1,230 @@
+package adaptor
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// when the values in a csv or tsv file are quoted
+const (
+	quoteMinimal = "minimal" // only the values that need it
+	quoteAll     = "all"
+	quoteNone    = "none" // never, values that need quotes can't be written
+)
+
+// the types a column can be read as.  columns without a type are inferred
+var columnTypes = map[string]struct{}{
+	"string": {},
+	"int":    {},
+	"float":  {},
+	"bool":   {},
+	"time":   {},
+	"json":   {},
+}
+
+/*
+ * read each row of a csv or tsv file as a document
+ */
+func (d *File) readCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.Comma = d.delimiter
+	reader.LazyQuotes = d.quote == quoteNone
+
+	columns := d.columns
+	var keep map[string]bool // the columns that are read, nil for every column
+	if d.header {
+		header, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't read header (%s)", err.Error()), nil)
+			return err
+		}
+		header[0] = strings.TrimPrefix(header[0], "\ufeff") // spreadsheets like to start with a byte order mark
+		if len(d.columns) > 0 {
+			keep = make(map[string]bool)
+			for _, column := range d.columns {
+				keep[column] = true
+			}
+		}
+		columns = header
+	} else if len(columns) == 0 {
+		err := NewError(CRITICAL, d.path, "Can't read file (a file without a header needs columns)", nil)
+		d.pipe.Err <- err
+		return err
+	} else {
+		reader.FieldsPerRecord = len(columns)
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't marshal document (%s)", err.Error()), nil)
+			return err
+		}
+
+		doc, err := d.rowDoc(columns, keep, row)
+		if err != nil {
+			d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't marshal document (%s)", err.Error()), nil)
+			return err
+		}
+		d.pipe.Send(message.NewMsg(message.Insert, doc))
+	}
+	return nil
+}
+
+// rowDoc builds a document from a row.  empty values are left out, and dotted column names are nested documents
+func (d *File) rowDoc(columns []string, keep map[string]bool, row []string) (bson.M, error) {
+	doc := bson.M{}
+	for n, column := range columns {
+		if (keep != nil && !keep[column]) || row[n] == "" {
+			continue
+		}
+		value, err := columnValue(d.types[column], row[n])
+		if err != nil {
+			return nil, fmt.Errorf("column %s, %s", column, err.Error())
+		}
+		setField(doc, strings.Split(column, "."), value)
+	}
+	return doc, nil
+}
+
+// columnValue converts a value to its column's type, or infers its type when the column doesn't have one
+func columnValue(kind, raw string) (interface{}, error) {
+	switch kind {
+	case "string":
+		return raw, nil
+	case "int":
+		return strconv.ParseInt(raw, 10, 64)
+	case "float":
+		return strconv.ParseFloat(raw, 64)
+	case "bool":
+		return strconv.ParseBool(raw)
+	case "time":
+		return time.Parse(time.RFC3339Nano, raw)
+	case "json":
+		var v interface{}
+		dec := json.NewDecoder(strings.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		return fromJSON(v), nil
+	}
+	return inferValue(raw), nil
+}
+
+// inferValue reads a value as a bool, an integer, a float or a time if it looks like one, and as a string if it doesn't.
+// numbers with a leading zero, i.e. 007 or 02134, are codes rather than numbers, so they're read as strings
+func inferValue(raw string) interface{} {
+	switch raw {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if leadingZero(raw) {
+		return raw
+	}
+	if i, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(raw, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f
+	}
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return t
+	}
+	return raw
+}
+
+// leadingZero is true when the value starts with a zero that's followed by another digit, after any sign
+func leadingZero(raw string) bool {
+	digits := strings.TrimLeft(raw, "+-")
+	return len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9'
+}
+
+/*
+ * write a document as a row of a csv or tsv file, writing the header first
+ */
+func (d *File) writeRow(doc bson.M) error {
+	flat := flattenDoc(doc)
+	if d.columns == nil { // every field of the first document
+		d.columns = make([]string, 0, len(flat))
+		for column := range flat {
+			d.columns = append(d.columns, column)
+		}
+		sort.Strings(d.columns)
+	}
+	if d.header && !d.wroteHeader {
+		if err := d.writeRecord(d.columns); err != nil {
+			return err
+		}
+		d.wroteHeader = true
+	}
+
+	record := make([]string, len(d.columns))
+	for n, column := range d.columns {
+		value, err := columnString(flat[column])
+		if err != nil {
+			return fmt.Errorf("column %s, %s", column, err.Error())
+		}
+		record[n] = value
+	}
+	return d.writeRecord(record)
+}
+
+// columnString formats a value for a column.  times are RFC 3339, and arrays are json
+func columnString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case bson.ObjectId:
+		return t.Hex(), nil
+	case time.Time:
+		return t.Format(time.RFC3339Nano), nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// writeRecord writes one row, quoting its values as the quote option asks
+func (d *File) writeRecord(record []string) error {
+	var (
+		buf     bytes.Buffer
+		special = string(d.delimiter) + "\"\r\n"
+	)
+	for n, value := range record {
+		if n > 0 {
+			buf.WriteRune(d.delimiter)
+		}
+		switch {
+		case d.quote == quoteAll, d.quote == quoteMinimal && (strings.ContainsAny(value, special) || strings.HasPrefix(value, " ")):
+			buf.WriteByte('"')
+			buf.WriteString(strings.Replace(value, `"`, `""`, -1))
+			buf.WriteByte('"')
+		case d.quote == quoteNone && strings.ContainsAny(value, string(d.delimiter)+"\r\n"):
+			return fmt.Errorf("%q can't be written without quotes", value)
+		default:
+			buf.WriteString(value)
+		}
+	}
+	buf.WriteByte('\n')
+	_, err := d.out.Write(buf.Bytes())
+	return err
+}
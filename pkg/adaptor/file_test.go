@@ -0,0 +1,344 @@
+package adaptor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newTestFile returns a file adaptor on the pipe, and a channel of the errors it reports
+func newTestFile(t *testing.T, p *pipe.Pipe, conf Config) (*File, chan error) {
+	conf["uri"] = "file:///tmp/transporter-test"
+	a, err := NewFile(p, "file", conf)
+	if err != nil {
+		t.Fatalf("can't create the adaptor: %s", err)
+	}
+	errs := make(chan error, 100)
+	go func() {
+		for err := range p.Err {
+			errs <- err
+		}
+	}()
+	return a.(*File), errs
+}
+
+func TestFileWriteCSV(t *testing.T) {
+	header := false
+	data := []struct {
+		in       Config
+		expected string
+	}{
+		{
+			Config{"format": "csv"},
+			"_id,at,name,stats.count,stats.score,tags\n" +
+				"1,2015-01-01T00:00:00Z,\"Smith, J\",2,1.5,\"[\"\"a\"\",\"\"b\"\"]\"\n" +
+				"2,,\" padded\",,,\n",
+		},
+		{
+			Config{"format": "tsv", "columns": []string{"name", "stats.count", "at"}},
+			"name\tstats.count\tat\n" +
+				"Smith, J\t2\t2015-01-01T00:00:00Z\n" +
+				"\" padded\"\t\t\n",
+		},
+		{
+			Config{"format": "csv", "delimiter": ";", "quote": "all", "header": &header, "columns": []string{"_id", "name"}},
+			"\"1\";\"Smith, J\"\n" +
+				"\"2\";\" padded\"\n",
+		},
+	}
+
+	docs := []bson.M{
+		{"_id": 1, "name": "Smith, J", "stats": bson.M{"count": 2, "score": 1.5}, "tags": []interface{}{"a", "b"}, "at": time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"_id": 2, "name": " padded", "missing": nil},
+	}
+
+	for _, d := range data {
+		f, errs := newTestFile(t, pipe.NewPipe(nil, "file"), d.in)
+		var out bytes.Buffer
+		f.out = &out
+		for _, doc := range docs {
+			f.dumpMessage(message.NewMsg(message.Insert, doc))
+		}
+		select {
+		case err := <-errs:
+			t.Errorf("%v: unexpected error %s", d.in, err)
+		default:
+		}
+		if out.String() != d.expected {
+			t.Errorf("%v: expected %q, got %q", d.in, d.expected, out.String())
+		}
+	}
+}
+
+func TestFileWriteUnquoted(t *testing.T) {
+	f, errs := newTestFile(t, pipe.NewPipe(nil, "file"), Config{"format": "csv", "quote": "none"})
+	var out bytes.Buffer
+	f.out = &out
+	f.dumpMessage(message.NewMsg(message.Insert, bson.M{"_id": 1, "name": `say "hi"`}))
+	f.dumpMessage(message.NewMsg(message.Insert, bson.M{"_id": 2, "name": "a,b"}))
+
+	if expected := "_id,name\n1,say \"hi\"\n"; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), `"a,b" can't be written without quotes`) {
+			t.Errorf("unexpected error %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected an error writing a value that needs quotes")
+	}
+}
+
+func TestFileReadCSV(t *testing.T) {
+	header := false
+	data := []struct {
+		in       Config
+		file     string
+		expected []bson.M
+	}{
+		{
+			Config{"format": "csv"},
+			"\ufeff_id,name,stats.count,stats.score,ok,at,zip\n" +
+				"1,\"Smith, J\",2,1.5,true,2015-01-01T00:00:00Z,02134\n" +
+				"2,\" padded\",,,,,\n",
+			[]bson.M{
+				{"_id": int64(1), "name": "Smith, J", "stats": bson.M{"count": int64(2), "score": 1.5}, "ok": true, "at": time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC), "zip": "02134"},
+				{"_id": int64(2), "name": " padded"},
+			},
+		},
+		{
+			Config{"format": "csv", "columns": []string{"_id", "zip", "tags"}, "types": map[string]string{"zip": "string", "tags": "json"}},
+			"_id,name,zip,tags\n" +
+				"1,Smith,02134,\"[\"\"a\"\",2]\"\n",
+			[]bson.M{
+				{"_id": int64(1), "zip": "02134", "tags": []interface{}{"a", int64(2)}},
+			},
+		},
+		{
+			Config{"format": "tsv", "header": &header, "columns": []string{"_id", "name"}, "types": map[string]string{"_id": "float"}},
+			"1\tSmith, J\n" +
+				"2\tinf\n",
+			[]bson.M{
+				{"_id": 1.0, "name": "Smith, J"},
+				{"_id": 2.0, "name": "inf"},
+			},
+		},
+	}
+
+	for _, d := range data {
+		source := pipe.NewPipe(nil, "file")
+		sink := pipe.NewPipe(source, "file/sink")
+		f, errs := newTestFile(t, source, d.in)
+
+		var (
+			docs []bson.M
+			done = make(chan struct{})
+		)
+		go func() {
+			for msg := range sink.In {
+				docs = append(docs, msg.Document())
+			}
+			close(done)
+		}()
+		if err := f.readCSV(strings.NewReader(d.file)); err != nil {
+			t.Errorf("%v: unexpected error %s", d.in, err)
+		}
+		close(sink.In)
+		<-done
+
+		select {
+		case err := <-errs:
+			t.Errorf("%v: unexpected error %s", d.in, err)
+		default:
+		}
+		if !reflect.DeepEqual(docs, d.expected) {
+			t.Errorf("%v: expected %#v, got %#v", d.in, d.expected, docs)
+		}
+	}
+}
+
+func TestInferValue(t *testing.T) {
+	data := []struct {
+		in       string
+		expected interface{}
+	}{
+		{"0", int64(0)},
+		{"10", int64(10)},
+		{"-3", int64(-3)},
+		{"0.5", 0.5},
+		{"-0.5", -0.5},
+		{"007", "007"},
+		{"02134", "02134"},
+		{"-01", "-01"},
+		{"00.5", "00.5"},
+		{"true", true},
+		{"Smith", "Smith"},
+	}
+	for _, v := range data {
+		if got := inferValue(v.in); !reflect.DeepEqual(got, v.expected) {
+			t.Errorf("%s: expected %#v, got %#v", v.in, v.expected, got)
+		}
+	}
+}
+
+func TestFileReadCSVFailures(t *testing.T) {
+	header := false
+	data := []struct {
+		in   Config
+		file string
+		err  string
+	}{
+		{Config{"format": "csv", "header": &header}, "1,2\n", "a file without a header needs columns"},
+		{Config{"format": "csv", "types": map[string]string{"count": "int"}}, "_id,count\n1,lots\n", "column count, strconv.ParseInt"},
+		{Config{"format": "csv"}, "_id,count\n1,2,3\n", "wrong number of fields"},
+	}
+
+	for _, d := range data {
+		f, errs := newTestFile(t, pipe.NewPipe(nil, "file"), d.in)
+		if err := f.readCSV(strings.NewReader(d.file)); err == nil {
+			t.Errorf("%v: expected an error", d.in)
+		}
+		if err := <-errs; !strings.Contains(err.Error(), d.err) {
+			t.Errorf("%v: expected %s, got %s", d.in, d.err, err)
+		}
+	}
+}
+
+// readTestFile reads the file with a new file adaptor, and returns the documents it sends
+func readTestFile(t *testing.T, conf Config) []bson.M {
+	source := pipe.NewPipe(nil, "file")
+	sink := pipe.NewPipe(source, "file/sink")
+	go func() {
+		for err := range source.Err {
+			t.Errorf("unexpected error %s", err)
+		}
+	}()
+	a, err := NewFile(source, "file", conf)
+	if err != nil {
+		t.Fatalf("can't create the adaptor: %s", err)
+	}
+
+	var (
+		docs []bson.M
+		done = make(chan struct{})
+	)
+	go func() {
+		for msg := range sink.In {
+			docs = append(docs, msg.Document())
+		}
+		close(done)
+	}()
+	if err := a.Start(); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	close(sink.In)
+	<-done
+	return docs
+}
+
+func TestFileCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []struct {
+		in       Config
+		expected []bson.M
+	}{
+		{
+			Config{"uri": "file://" + filepath.Join(dir, "out.json.gz")},
+			[]bson.M{{"_id": float64(1), "name": "a"}, {"_id": float64(2)}},
+		},
+		{
+			Config{"uri": "file://" + filepath.Join(dir, "out.csv"), "format": "csv", "compression": "gzip"},
+			[]bson.M{{"_id": int64(1), "name": "a"}, {"_id": int64(2)}},
+		},
+	}
+
+	for _, d := range data {
+		a, err := NewFile(pipe.NewPipe(nil, "file"), "file", d.in)
+		if err != nil {
+			t.Fatalf("can't create the adaptor: %s", err)
+		}
+		f := a.(*File)
+		if err := f.openOutput(); err != nil {
+			t.Fatalf("%v: can't open the file: %s", d.in, err)
+		}
+		f.dumpMessage(message.NewMsg(message.Insert, bson.M{"_id": 1, "name": "a"}))
+		f.dumpMessage(message.NewMsg(message.Insert, bson.M{"_id": 2}))
+		if err := f.Stop(); err != nil {
+			t.Errorf("%v: unexpected error %s", d.in, err)
+		}
+
+		// the file's a complete gzip stream
+		in, err := os.Open(strings.TrimPrefix(d.in["uri"].(string), "file://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			t.Fatalf("%v: expected a gzip file, %s", d.in, err)
+		}
+		if _, err := ioutil.ReadAll(gz); err != nil {
+			t.Errorf("%v: expected the whole gzip stream to be written, %s", d.in, err)
+		}
+		in.Close()
+
+		if docs := readTestFile(t, d.in); !reflect.DeepEqual(docs, d.expected) {
+			t.Errorf("%v: expected %#v, got %#v", d.in, d.expected, docs)
+		}
+	}
+
+	// bzip2 files can only be read
+	bz := "\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xaf\xe3\xf9\xb9\x00\x00\x0f\xdb\x80\x00\x10\x50\x04\x30\x10\x00\x00\xa6\x23\x00\x0a\x20\x00" +
+		"\x21\x2a\x34\x69\xa0\x36\xa1\x4c\x00\x13\x44\x43\xd4\xe7\x04\x41\xdd\xb1\xb2\x8a\x44\x88\x79\x13\x7c\x5d\xc9\x14\xe1\x42\x42\xbf\x8f\xe6\xe4"
+	filename := filepath.Join(dir, "in.json.bz2")
+	if err := ioutil.WriteFile(filename, []byte(bz), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected := []bson.M{{"_id": float64(1), "name": "a"}, {"_id": float64(2)}}
+	if docs := readTestFile(t, Config{"uri": "file://" + filename}); !reflect.DeepEqual(docs, expected) {
+		t.Errorf("expected %#v, got %#v", expected, docs)
+	}
+
+	a, err := NewFile(pipe.NewPipe(nil, "file"), "file", Config{"uri": "file://" + filename})
+	if err != nil {
+		t.Fatalf("can't create the adaptor: %s", err)
+	}
+	if err := a.(*File).openOutput(); err == nil {
+		t.Errorf("expected an error writing a bzip2 file")
+	}
+}
+
+func TestNewFile(t *testing.T) {
+	data := []Config{
+		{"format": "xml"},
+		{"format": "csv", "delimiter": "::"},
+		{"format": "csv", "delimiter": "\""},
+		{"format": "csv", "quote": "sometimes"},
+		{"format": "csv", "types": map[string]string{"at": "date"}},
+		{"compression": "lzma"},
+		{"uri": "file:///tmp/transporter-test.json.zst"},
+	}
+	for _, conf := range data {
+		if conf["uri"] == nil {
+			conf["uri"] = "file:///tmp/transporter-test"
+		}
+		if _, err := NewFile(nil, "file", conf); err == nil {
+			t.Errorf("%v: expected an error", conf)
+		}
+	}
+}
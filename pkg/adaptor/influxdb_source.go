@@ -0,0 +1,237 @@
+package adaptor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// an influxResult is one series of a query's results.  the 0.8 api calls the values points, and
+// only returns tags as columns
+type influxResult struct {
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+	Points  [][]interface{}   `json:"points"`
+}
+
+// Start the adaptor as a source.  the query is run, or the whole measurement is read a window of time at a time, and each
+// point is sent as an insert, with its time and tags.  the point's _id is its series and time, so that reading it again
+// sends the same document
+func (i *Influxdb) Start() (err error) {
+	defer func() {
+		i.pipe.Stop()
+	}()
+
+	if i.target.dynamic() {
+		err = NewError(CRITICAL, i.path, "Influxdb error (a source can't read from a templated namespace)", nil)
+		i.pipe.Err <- err
+		return err
+	}
+
+	if i.query != "" {
+		err = i.readQuery(i.query)
+	} else {
+		err = i.readMeasurement()
+	}
+	if err != nil {
+		i.pipe.Err <- err
+		return err
+	}
+
+	// let the sinks know the copy is done
+	i.pipe.Send(message.NewMsg(message.Command, bson.M{"flush": true, "copied": true}))
+	return nil
+}
+
+// readMeasurement reads the measurement a window at a time, from the start, or the first point, up to the end, or now
+func (i *Influxdb) readMeasurement() error {
+	start, end := i.start, i.end
+	if start.IsZero() {
+		series, err := i.runQuery(i.firstPointQuery())
+		if err != nil {
+			return err
+		}
+		if len(series) == 0 || len(i.rows(series[0])) == 0 { // the measurement is empty
+			return nil
+		}
+		if start, err = i.pointTime(series[0], i.rows(series[0])[0]); err != nil {
+			return NewError(CRITICAL, i.path, fmt.Sprintf("Influxdb error (%s)", err.Error()), nil)
+		}
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	for from := start; from.Before(end); from = from.Add(i.window) {
+		if stop := i.pipe.Stopped; stop {
+			return nil
+		}
+		to := from.Add(i.window)
+		if to.After(end) {
+			to = end
+		}
+		if err := i.readQuery(i.windowQuery(from, to)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstPointQuery finds the oldest point in the measurement
+func (i *Influxdb) firstPointQuery() string {
+	if i.protocol == influxLine {
+		return fmt.Sprintf(`SELECT * FROM "%s" LIMIT 1`, i.seriesName)
+	}
+	return fmt.Sprintf(`select * from "%s" limit 1 order asc`, i.seriesName)
+}
+
+// windowQuery reads the points from the start of the window up to, but not including, its end, grouped by
+// their tags so that the tags can be told apart from the fields
+func (i *Influxdb) windowQuery(from, to time.Time) string {
+	if i.protocol == influxLine {
+		return fmt.Sprintf(`SELECT * FROM "%s" WHERE time >= %d AND time < %d GROUP BY *`, i.seriesName, from.UnixNano(), to.UnixNano())
+	}
+	return fmt.Sprintf(`select * from "%s" where time > %du and time < %du order asc`,
+		i.seriesName, from.UnixNano()/int64(time.Microsecond)-1, to.UnixNano()/int64(time.Microsecond))
+}
+
+// readQuery runs the query, and sends each point it returns
+func (i *Influxdb) readQuery(query string) error {
+	series, err := i.runQuery(query)
+	if err != nil {
+		return err
+	}
+	for _, s := range series {
+		for _, row := range i.rows(s) {
+			if stop := i.pipe.Stopped; stop {
+				return nil
+			}
+			msg, err := i.pointMsg(s, row)
+			if err != nil {
+				return NewError(CRITICAL, i.path, fmt.Sprintf("Influxdb error (%s)", err.Error()), nil)
+			}
+			i.pipe.Send(msg)
+		}
+	}
+	return nil
+}
+
+// runQuery runs a query against the database, and returns the series in the results
+func (i *Influxdb) runQuery(query string) ([]influxResult, error) {
+	var (
+		endpoint string
+		params   = url.Values{"q": {query}}
+	)
+	i.setAuth(params)
+	if i.protocol == influxLine {
+		endpoint = "/query"
+		params.Set("db", i.database)
+		params.Set("epoch", "ns")
+	} else {
+		endpoint = "/db/" + url.QueryEscape(i.database) + "/series"
+		params.Set("time_precision", "ms")
+	}
+
+	resp, err := i.client.Get(i.baseURL() + endpoint + "?" + params.Encode())
+	if err != nil {
+		return nil, NewError(CRITICAL, i.path, fmt.Sprintf("Influxdb error (%s)", err.Error()), nil)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, NewError(CRITICAL, i.path, fmt.Sprintf("Influxdb error (query %s failed, %d %s)", query, resp.StatusCode, strings.TrimSpace(string(body))), nil)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if i.protocol != influxLine {
+		var series []influxResult
+		if err := dec.Decode(&series); err != nil {
+			return nil, NewError(CRITICAL, i.path, fmt.Sprintf("Influxdb error (malformed response to %s, %s)", query, err.Error()), nil)
+		}
+		return series, nil
+	}
+
+	var result struct {
+		Results []struct {
+			Series []influxResult `json:"series"`
+			Error  string         `json:"error"`
+		} `json:"results"`
+		Error string `json:"error"`
+	}
+	if err := dec.Decode(&result); err != nil {
+		return nil, NewError(CRITICAL, i.path, fmt.Sprintf("Influxdb error (malformed response to %s, %s)", query, err.Error()), nil)
+	}
+	var series []influxResult
+	for _, r := range result.Results {
+		if r.Error != "" {
+			result.Error = r.Error
+		}
+		series = append(series, r.Series...)
+	}
+	if result.Error != "" {
+		return nil, NewError(CRITICAL, i.path, fmt.Sprintf("Influxdb error (query %s failed, %s)", query, result.Error), nil)
+	}
+	return series, nil
+}
+
+// rows are the series' values, or its points for the 0.8 api
+func (i *Influxdb) rows(s influxResult) [][]interface{} {
+	if i.protocol == influxLine {
+		return s.Values
+	}
+	return s.Points
+}
+
+// pointMsg builds the insert for one point, a document with its time, tags and fields.  fields without a value are left out
+func (i *Influxdb) pointMsg(s influxResult, row []interface{}) (*message.Msg, error) {
+	t, err := i.pointTime(s, row)
+	if err != nil {
+		return nil, err
+	}
+
+	point := influxPoint{measurement: s.Name, tags: s.Tags}
+	doc := bson.M{"time": t}
+	for tag, value := range s.Tags {
+		doc[tag] = value
+	}
+	for n, column := range s.Columns {
+		if column == "time" || column == "sequence_number" || n >= len(row) || row[n] == nil {
+			continue
+		}
+		doc[column] = fromJSON(row[n])
+	}
+	doc["_id"] = point.key() + " " + strconv.FormatInt(t.UnixNano(), 10)
+
+	msg := message.NewMsg(message.Insert, doc)
+	msg.Namespace = i.database + "." + s.Name
+	return msg, nil
+}
+
+// pointTime reads the time column of a row, in nanoseconds, or milliseconds from the 0.8 api
+func (i *Influxdb) pointTime(s influxResult, row []interface{}) (time.Time, error) {
+	for n, column := range s.Columns {
+		if column != "time" || n >= len(row) {
+			continue
+		}
+		v, ok := fromJSON(row[n]).(int64)
+		if !ok {
+			return time.Time{}, fmt.Errorf("malformed time %v", row[n])
+		}
+		if i.protocol == influxLine {
+			return time.Unix(0, v).UTC(), nil
+		}
+		return time.Unix(0, v*int64(time.Millisecond)).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("point has no time")
+}
@@ -0,0 +1,386 @@
+package adaptor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// influxRecorder stands in for influxdb, and records every write it's sent
+type influxRecorder struct {
+	urls   []string
+	bodies []string
+	sync.Mutex
+}
+
+func (s *influxRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.Lock()
+	defer s.Unlock()
+	s.urls = append(s.urls, r.URL.String())
+	s.bodies = append(s.bodies, string(body))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newTestInfluxdb returns an influxdb sink writing to the server, and a channel of the errors it reports
+func newTestInfluxdb(t *testing.T, server *httptest.Server, extra Config) (*Influxdb, chan error) {
+	source := pipe.NewPipe(nil, "source")
+	sink := pipe.NewPipe(source, "source/influx")
+
+	conf := Config{"uri": strings.Replace(server.URL, "http://", "influxdb://root:secret@", 1) + "/metrics", "namespace": "metrics.cpu"}
+	for k, v := range extra {
+		conf[k] = v
+	}
+	a, err := NewInfluxdb(sink, "source/influx", conf)
+	if err != nil {
+		t.Fatalf("can't create the adaptor: %s", err)
+	}
+
+	errs := make(chan error, 100)
+	go func() {
+		for err := range source.Err {
+			errs <- err
+		}
+	}()
+	return a.(*Influxdb), errs
+}
+
+func TestInfluxdbLineProtocol(t *testing.T) {
+	recorder := &influxRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	i, errs := newTestInfluxdb(t, server, Config{
+		"protocol":   "line",
+		"tags":       []string{"host", "region"},
+		"time_field": "at",
+		"bulk_size":  2,
+	})
+
+	msgs := []*message.Msg{
+		message.NewMsg(message.Insert, bson.M{"_id": 1, "host": "a", "region": "us east", "at": "2015-01-01T00:00:00Z", "user": 1.5, "count": int64(2), "cpu": bson.M{"idle": true}}),
+		message.NewMsg(message.Insert, bson.M{"_id": 2, "host": "b", "at": "2015-01-01T00:00:01Z", "note": `say "hi"`}),
+		message.NewMsg(message.Insert, bson.M{"_id": 3, "host": "c", "at": "2015-01-01T00:00:02Z", "user": 2.0}),
+		message.NewMsg(message.Update, bson.M{"_id": 3, "host": "c", "user": 3.0}),
+		message.NewMsg(message.Update, bson.M{"_id": 3, "host": "c", "user": 4.0}),
+	}
+	for _, msg := range msgs {
+		i.applyOp(msg)
+	}
+	if len(recorder.bodies) != 1 {
+		t.Fatalf("expected the first two points to be written together, got %d writes", len(recorder.bodies))
+	}
+	i.applyOp(message.NewMsg(message.Command, bson.M{"flush": true}))
+
+	// updates can't be applied to points, and that's only reported once
+	want := NewError(ERROR, "source/influx", "Influxdb error (updates aren't supported, this one and the ones after it are ignored)", bson.M{"_id": 3, "host": "c", "user": 3.0})
+	select {
+	case err := <-errs:
+		if !reflect.DeepEqual(err, want) {
+			t.Errorf("expected %+v, got %+v", want, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected the update to be reported")
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error %s", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	expected := []string{
+		"cpu,host=a,region=us\\ east count=2i,cpu.idle=true,user=1.5 1420070400000000000\n" +
+			"cpu,host=b note=\"say \\\"hi\\\"\" 1420070401000000000\n",
+		"cpu,host=c user=2 1420070402000000000\n",
+	}
+	if !reflect.DeepEqual(recorder.bodies, expected) {
+		t.Errorf("expected %q, got %q", expected, recorder.bodies)
+	}
+	for _, u := range recorder.urls {
+		if u != "/write?db=metrics&p=secret&u=root" {
+			t.Errorf("unexpected url %s", u)
+		}
+	}
+}
+
+func TestInfluxdbSeries(t *testing.T) {
+	recorder := &influxRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	i, errs := newTestInfluxdb(t, server, Config{"tags": []string{"host"}, "fields": []string{"user"}})
+
+	msg := message.NewMsg(message.Insert, bson.M{"_id": 1, "host": "a", "user": 1.5, "ignored": 1})
+	msg.Timestamp = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	i.applyOp(msg)
+
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error %s", err)
+	default:
+	}
+
+	if len(recorder.bodies) != 1 {
+		t.Fatalf("expected one write to the series api, got %v", recorder.urls)
+	}
+	u, _ := url.Parse(recorder.urls[0])
+	if expected := (url.Values{"u": {"root"}, "p": {"secret"}, "time_precision": {"ms"}}); u.Path != "/db/metrics/series" || !reflect.DeepEqual(u.Query(), expected) {
+		t.Errorf("expected a write to /db/metrics/series with %v, got %s", expected, recorder.urls[0])
+	}
+	var series []map[string]interface{}
+	json.Unmarshal([]byte(recorder.bodies[0]), &series)
+	expected := []map[string]interface{}{
+		{"name": "cpu", "columns": []interface{}{"time", "host", "user"}, "points": []interface{}{[]interface{}{float64(1420070400000), "a", 1.5}}},
+	}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("expected %v, got %v", expected, series)
+	}
+}
+
+func TestInfluxdbReportsFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"database not found: \"metrics\""}`, http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	i, errs := newTestInfluxdb(t, server, Config{"protocol": "line", "time_field": "at"})
+	i.applyOp(message.NewMsg(message.Insert, bson.M{"_id": 1, "user": 1.5}))
+	i.applyOp(message.NewMsg(message.Insert, bson.M{"_id": 2, "at": true, "user": 1.5}))
+	i.applyOp(message.NewMsg(message.Insert, bson.M{"_id": 3}))
+
+	expected := []string{
+		`write of 1 points failed, 404 {"error":"database not found: \"metrics\""}`,
+		"at isn't a time (unexpected bool)",
+		"document has no fields to write",
+	}
+	for _, want := range expected {
+		select {
+		case err := <-errs:
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("expected %s, got %s", want, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s, got nothing", want)
+		}
+	}
+}
+
+func TestNewInfluxdb(t *testing.T) {
+	if _, err := NewInfluxdb(nil, "influx", Config{"uri": "influxdb://localhost:8086/metrics", "namespace": "metrics.cpu", "protocol": "udp"}); err == nil {
+		t.Errorf("expected an error for an unknown protocol")
+	}
+	if _, err := NewInfluxdb(nil, "influx", Config{"uri": "influxdb://localhost:8086/metrics", "namespace": "metrics"}); err == nil {
+		t.Errorf("expected an error for a namespace without a measurement")
+	}
+	if _, err := NewInfluxdb(nil, "influx", Config{"uri": "influxdb://localhost:8086/metrics", "namespace": "metrics.cpu", "window": "-1h"}); err == nil {
+		t.Errorf("expected an error for a negative window")
+	}
+	if _, err := NewInfluxdb(nil, "influx", Config{"uri": "influxdb://localhost:8086/metrics", "namespace": "metrics.cpu", "start": "yesterday"}); err == nil {
+		t.Errorf("expected an error for a malformed start")
+	}
+}
+
+// influxQueryServer stands in for influxdb's query api, answering each query it knows with its response, and an empty result otherwise
+type influxQueryServer struct {
+	responses map[string]string
+	queries   []string
+	urls      []string
+	sync.Mutex
+}
+
+func (s *influxQueryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	q := r.URL.Query().Get("q")
+	s.queries = append(s.queries, q)
+	s.urls = append(s.urls, r.URL.Path)
+	if response, ok := s.responses[q]; ok {
+		w.Write([]byte(response))
+		return
+	}
+	if r.URL.Path == "/query" {
+		w.Write([]byte(`{"results": [{}]}`))
+		return
+	}
+	w.Write([]byte(`[]`))
+}
+
+// readInflux starts an influxdb source reading from the server, and returns the points it sends, and whether it finished with a copied command
+func readInflux(t *testing.T, server *httptest.Server, extra Config) ([]*message.Msg, bool) {
+	source := pipe.NewPipe(nil, "influx")
+	sink := pipe.NewPipe(source, "influx/sink")
+	go func() {
+		for err := range source.Err {
+			t.Errorf("unexpected error %v", err)
+		}
+	}()
+
+	conf := Config{"uri": strings.Replace(server.URL, "http://", "influxdb://root:secret@", 1) + "/metrics", "namespace": "metrics.cpu"}
+	for k, v := range extra {
+		conf[k] = v
+	}
+	a, err := NewInfluxdb(source, "influx", conf)
+	if err != nil {
+		t.Fatalf("can't create the adaptor: %s", err)
+	}
+
+	var (
+		msgs []*message.Msg
+		last *message.Msg
+		done = make(chan struct{})
+	)
+	go func() {
+		for msg := range sink.In {
+			if msg.Op != message.Command {
+				msgs = append(msgs, msg)
+			}
+			last = msg
+		}
+		close(done)
+	}()
+
+	if err := a.Start(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	close(sink.In)
+	<-done
+	return msgs, last != nil && last.Op == message.Command && last.Document()["copied"] == true
+}
+
+func TestInfluxdbSourceQuery(t *testing.T) {
+	query := `SELECT * FROM "cpu" WHERE host = 'a' GROUP BY *`
+	server := &influxQueryServer{responses: map[string]string{
+		query: `{"results": [{"series": [
+			{"name": "cpu", "tags": {"host": "a", "region": ""}, "columns": ["time", "user", "idle"], "values": [[1420070400000000000, 1.5, null], [1420070401000000000, 2, true]]}
+		]}]}`,
+	}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	msgs, copied := readInflux(t, ts, Config{"protocol": "line", "query": query})
+	if !copied {
+		t.Errorf("expected the read to finish with a copied command")
+	}
+
+	expected := []bson.M{
+		{"_id": "cpu,host=a 1420070400000000000", "time": time.Unix(1420070400, 0).UTC(), "host": "a", "region": "", "user": 1.5},
+		{"_id": "cpu,host=a 1420070401000000000", "time": time.Unix(1420070401, 0).UTC(), "host": "a", "region": "", "user": int64(2), "idle": true},
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expected %d messages, got %d", len(expected), len(msgs))
+	}
+	for n, msg := range msgs {
+		if msg.Op != message.Insert || msg.Namespace != "metrics.cpu" {
+			t.Errorf("%d: expected an insert into metrics.cpu, got %s into %s", n, msg.Op, msg.Namespace)
+		}
+		if !reflect.DeepEqual(msg.Document(), expected[n]) {
+			t.Errorf("%d: expected %#v, got %#v", n, expected[n], msg.Document())
+		}
+	}
+	if !reflect.DeepEqual(server.queries, []string{query}) {
+		t.Errorf("expected only the query to be run, got %v", server.queries)
+	}
+}
+
+func TestInfluxdbSourceWindows(t *testing.T) {
+	data := []struct {
+		in       Config
+		first    string
+		response map[int]string // the response to each window, by its index
+		queries  []string
+		times    []int64
+	}{
+		{
+			Config{"protocol": "line", "window": "1h", "end": "2015-01-01T02:30:00Z"},
+			`{"results": [{"series": [{"name": "cpu", "columns": ["time", "user"], "values": [[1420070400000000000, 1]]}]}]}`,
+			map[int]string{
+				0: `{"results": [{"series": [{"name": "cpu", "tags": {"host": "a"}, "columns": ["time", "user"], "values": [[1420070400000000000, 1]]}]}]}`,
+				2: `{"results": [{"series": [{"name": "cpu", "tags": {"host": "b"}, "columns": ["time", "user"], "values": [[1420077600000000000, 3]]}]}]}`,
+			},
+			[]string{
+				`SELECT * FROM "cpu" WHERE time >= 1420070400000000000 AND time < 1420074000000000000 GROUP BY *`,
+				`SELECT * FROM "cpu" WHERE time >= 1420074000000000000 AND time < 1420077600000000000 GROUP BY *`,
+				`SELECT * FROM "cpu" WHERE time >= 1420077600000000000 AND time < 1420079400000000000 GROUP BY *`,
+			},
+			[]int64{1420070400, 1420077600},
+		},
+		{
+			Config{"window": "24h", "start": "2015-01-01T00:00:00Z", "end": "2015-01-02T00:00:00Z"},
+			"",
+			map[int]string{
+				0: `[{"name": "cpu", "columns": ["time", "sequence_number", "host", "user"], "points": [[1420070400000, 1, "a", 1]]}]`,
+			},
+			[]string{
+				`select * from "cpu" where time > 1420070399999999u and time < 1420156800000000u order asc`,
+			},
+			[]int64{1420070400},
+		},
+	}
+
+	for _, d := range data {
+		server := &influxQueryServer{responses: map[string]string{}}
+		if d.first != "" {
+			server.responses[`SELECT * FROM "cpu" LIMIT 1`] = d.first
+		}
+		for n, response := range d.response {
+			server.responses[d.queries[n]] = response
+		}
+		ts := httptest.NewServer(server)
+
+		msgs, copied := readInflux(t, ts, d.in)
+		ts.Close()
+		if !copied {
+			t.Errorf("%v: expected the read to finish with a copied command", d.in)
+		}
+
+		queries := d.queries
+		if d.first != "" {
+			queries = append([]string{`SELECT * FROM "cpu" LIMIT 1`}, queries...)
+		}
+		if !reflect.DeepEqual(server.queries, queries) {
+			t.Errorf("%v: expected queries %q, got %q", d.in, queries, server.queries)
+		}
+		var times []int64
+		for _, msg := range msgs {
+			times = append(times, msg.Document()["time"].(time.Time).Unix())
+		}
+		if !reflect.DeepEqual(times, d.times) {
+			t.Errorf("%v: expected points at %v, got %v", d.in, d.times, times)
+		}
+	}
+}
+
+func TestInfluxdbSourceReportsFailures(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results": [{"error": "measurement not found"}]}`))
+	}))
+	defer ts.Close()
+
+	source := pipe.NewPipe(nil, "influx")
+	errs := make(chan error, 1)
+	go func() {
+		for err := range source.Err {
+			errs <- err
+		}
+	}()
+
+	a, err := NewInfluxdb(source, "influx", Config{"uri": strings.Replace(ts.URL, "http://", "influxdb://", 1) + "/metrics", "namespace": "metrics.cpu", "protocol": "line", "query": "SELECT * FROM nothing"})
+	if err != nil {
+		t.Fatalf("can't create the adaptor: %s", err)
+	}
+	if err := a.Start(); err == nil || !strings.Contains(err.Error(), "measurement not found") {
+		t.Errorf("expected the query's error, got %v", err)
+	}
+	<-errs
+}
@@ -1,12 +1,17 @@
 package adaptor
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/compose/transporter/pkg/message"
 	"github.com/compose/transporter/pkg/pipe"
+	"github.com/compose/transporter/pkg/state"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -15,25 +20,68 @@ import (
 // it works as a source by copying files, and then optionally tailing the oplog
 type Mongodb struct {
 	// pull these in from the node
-	uri   string
-	tail  bool // run the tail oplog
-	debug bool
+	uri    string
+	tail   bool // run the tail oplog
+	resume bool // skip the copy and tail from the last checkpoint
+	debug  bool
+
+	fullDocument bool // fetch the whole document for updates, as well as the modifier
+	modifiers    bool // the sink applies updates that only carry a modifier
+
+	copyParallelism int // how many cursors copy each collection
+
+	// the source only reads the documents matching query, and only the listed fields of them
+	query  bson.M
+	fields []string
 
 	// save time by setting these once
 	collection string
 	database   string
 
+	// matches the collections to read when the namespace names more than one, i.e. db.* or db./regex/.
+	// nil when the namespace is a single collection
+	collectionMatch *regexp.Regexp
+
+	// where a sink writes each message, when the namespace is a template like {db}.{collection}
+	target *namespaceTemplate
+
+	// buffers a sink's writes, nil when writing one message at a time
+	bulk *batch
+
 	oplogTime bson.MongoTimestamp
 
+	// the shards behind a mongos, each with its own oplog.  nil when we're connected to a replica set
+	shards []*oplogShard
+
+	// closed by Stop, so that tailing the shards, which runs alongside their readers, can quit without racing on pipe.Stopped
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// where we record our oplog position, nil if we aren't checkpointing.  a position is only saved once the
+	// sinks have flushed everything sent before it, pendingCheckpoint is the one waiting on their flush
+	checkpoints       state.Store
+	lastCheckpoint    time.Time
+	pendingCheckpoint *oplogCheckpoint
+
 	//
 	pipe *pipe.Pipe
 	path string
 
 	// mongo connection and options
+	dialInfo     *mgo.DialInfo
 	mongoSession *mgo.Session
 	oplogTimeout time.Duration
 
+	readMode mgo.Mode  // which members of the replica set the source reads from
+	safe     *mgo.Safe // the sink's write concern, used when setSafe is true
+	setSafe  bool
+	retries  retryPolicy // how transient errors are retried
+
 	restartable bool // this refers to being able to refresh the iterator, not to the restart based on session op
+
+	// tailOplog opens a tailing cursor on the oplog for entries after the given timestamp.
+	// this is swapped out for a fake oplog in tests
+	tailOplog func(bson.MongoTimestamp) oplogIterator
 }
 
 // NewMongodb creates a new Mongodb adaptor
@@ -55,22 +103,97 @@ func NewMongodb(p *pipe.Pipe, path string, extra Config) (StopStartListener, err
 	}
 
 	m := &Mongodb{
-		restartable:  true,            // assume for that we're able to restart the process
-		oplogTimeout: 5 * time.Second, // timeout the oplog iterator
-		pipe:         p,
-		uri:          conf.URI,
-		tail:         conf.Tail,
-		debug:        conf.Debug,
-		path:         path,
+		restartable:     true,            // assume for that we're able to restart the process
+		oplogTimeout:    5 * time.Second, // timeout the oplog iterator
+		pipe:            p,
+		stop:            make(chan struct{}),
+		uri:             conf.URI,
+		tail:            conf.Tail || conf.Resume,
+		resume:          conf.Resume,
+		fullDocument:    conf.FullDocument == nil || *conf.FullDocument,
+		modifiers:       conf.Modifiers,
+		copyParallelism: conf.CopyParallelism,
+		fields:          conf.Fields,
+		debug:           conf.Debug,
+		path:            path,
+	}
+	m.tailOplog = m.openOplog
+
+	m.query, err = parseQuery(conf.Query)
+	if err != nil {
+		return m, err
+	}
+	if err = checkQuery(m.query); err != nil {
+		return m, fmt.Errorf("unsupported query, it has to be applied to the oplog too (%s)", err.Error())
+	}
+
+	m.readMode, err = readMode(conf.ReadPreference)
+	if err != nil {
+		return m, err
+	}
+	m.safe, m.setSafe, err = mongoSafe(conf)
+	if err != nil {
+		return m, err
+	}
+	m.retries, err = newRetryPolicy(conf.MaxRetries, conf.RetryBackoff)
+	if err != nil {
+		return m, err
+	}
+
+	if conf.BulkSize > 1 {
+		var interval time.Duration
+		if conf.FlushInterval != "" {
+			interval, err = time.ParseDuration(conf.FlushInterval)
+			if err != nil {
+				return m, fmt.Errorf("malformed flush_interval (%s)", err.Error())
+			}
+		}
+		m.bulk = newBatch(conf.BulkSize, interval, m.writeBulk)
+	}
+
+	if conf.Resume && conf.Checkpoint == "" {
+		conf.Checkpoint = state.DefaultURI
+	}
+	if conf.Checkpoint != "" {
+		m.checkpoints, err = state.NewStore(conf.Checkpoint)
+		if err != nil {
+			return m, err
+		}
 	}
 
 	m.database, m.collection, err = m.splitNamespace(conf.Namespace)
 	if err != nil {
 		return m, err
 	}
+	m.collectionMatch, err = parseCollectionMatch(m.collection)
+	if err != nil {
+		return m, err
+	}
+	if m.collectionMatch == nil {
+		m.target, err = newNamespaceTemplate(conf.Namespace)
+		if err != nil {
+			return m, err
+		}
+	}
 
-	m.mongoSession, err = mgo.Dial(m.uri)
-	return m, err
+	m.dialInfo, err = mongoDialInfo(conf)
+	if err != nil {
+		return m, err
+	}
+	m.mongoSession, err = mgo.DialWithInfo(m.dialInfo)
+	if err != nil {
+		return m, err
+	}
+	m.configureSession(m.mongoSession)
+	return m, nil
+}
+
+// configureSession applies the read preference and write concern to the session
+func (m *Mongodb) configureSession(session *mgo.Session) {
+	session.SetMode(m.readMode, true)
+	if m.setSafe {
+		session.SetSafe(m.safe)
+	}
 }
 
 // Start the adaptor as a source
@@ -79,19 +202,55 @@ func (m *Mongodb) Start() (err error) {
 		m.pipe.Stop()
 	}()
 
-	m.oplogTime = nowAsMongoTimestamp()
-	if m.debug {
-		fmt.Printf("setting start timestamp: %d", m.oplogTime)
+	if m.tail {
+		// behind a mongos, each shard has its own oplog, which we have to tail separately
+		m.shards, err = m.findShards()
+		if err != nil {
+			m.pipe.Err <- err
+			return err
+		}
+		defer m.closeShards()
 	}
 
-	err = m.catData()
+	resumed, err := m.loadCheckpoint()
 	if err != nil {
 		m.pipe.Err <- err
 		return err
 	}
+
+	if resumed {
+		// let the sinks know there's no copy coming
+		m.pipe.Send(message.NewMsg(message.Command, bson.M{"resumed": true}))
+	} else {
+		// snapshot the oplog position before we start the copy, so that the tail can
+		// replay everything that happened while the copy was running
+		if m.tail {
+			err = m.snapshotOplogTime()
+			if err != nil {
+				m.pipe.Err <- err
+				return err
+			}
+		}
+		if m.debug {
+			fmt.Printf("setting start timestamp: %d", m.oplogTime)
+		}
+
+		err = m.catData()
+		if err != nil {
+			m.pipe.Err <- err
+			return err
+		}
+
+		// let the sinks know the copy is done
+		m.pipe.Send(message.NewMsg(message.Command, bson.M{"flush": true, "copied": true}))
+	}
 	if m.tail {
 		// replay the oplog
-		err = m.tailData()
+		if m.shards != nil {
+			err = m.tailShards()
+		} else {
+			err = m.tailData()
+		}
 		if err != nil {
 			m.pipe.Err <- err
 			return err
@@ -104,41 +263,140 @@ func (m *Mongodb) Start() (err error) {
 // Listen starts the pipe's listener
 func (m *Mongodb) Listen() (err error) {
 	defer func() {
-		m.pipe.Stop()
+		m.Stop()
 	}()
+	if m.bulk != nil {
+		m.bulk.start()
+	}
 	return m.pipe.Listen(m.writeMessage)
 }
 
-// Stop the adaptor
+// Stop the adaptor, and flush any buffered writes
 func (m *Mongodb) Stop() error {
+	m.stopOnce.Do(func() {
+		if m.stop != nil {
+			close(m.stop)
+		}
+	})
 	m.pipe.Stop()
+	if m.bulk != nil {
+		m.bulk.stop()
+	}
 	return nil
 }
 
-// writeMessage writes one message to the destination mongo, or sends an error down the pipe
-// TODO this can be cleaned up.  I'm not sure whether this should pipe the error, or whether the
-//   caller should pipe the error
+// writeMessage applies one message to the destination mongo, or sends an error down the pipe.
+// inserts that collide with an existing document replace it, updates upsert the whole document, or apply their
+// modifier when that's all they carry and modifiers is set, and deletes remove the document.  commands are a
+// barrier, that flush any buffered writes
 func (m *Mongodb) writeMessage(msg *message.Msg) (*message.Msg, error) {
-	collection := m.mongoSession.DB(m.database).C(m.collection)
-	err := collection.Insert(msg.Document())
-	if mgo.IsDup(err) {
-		err = collection.Update(bson.M{"_id": msg.ID}, msg.Document())
+	if msg.Op == message.Command {
+		if m.bulk != nil {
+			m.bulk.flush()
+		}
+		return msg, nil
+	}
+	if modifierOnly(msg) && !m.modifiers {
+		m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (%s, or modifiers on the sink)", errModifierOnly.Error()), msg.Document())
+		return msg, nil
 	}
+
+	collection, err := m.targetCollection(msg)
+	if err != nil {
+		m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (%s)", err.Error()), msg.Document())
+		return msg, nil
+	}
+
+	if m.bulk != nil {
+		m.bulk.add(collection.FullName, mongoWrite{collection, msg})
+		return msg, nil
+	}
+
+	err = m.retries.do(m.mongoSession, func() error {
+		return writeOne(collection, msg)
+	})
 	if err != nil {
 		m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (%s)", err.Error()), msg.Document())
 	}
 	return msg, nil
 }
 
-// catdata pulls down the original collection
+// writeOne applies a single message to the collection
+func writeOne(collection *mgo.Collection, msg *message.Msg) (err error) {
+	switch msg.Op {
+	case message.Delete:
+		err = collection.RemoveId(msg.ID)
+		if err == mgo.ErrNotFound { // it's already gone
+			err = nil
+		}
+	case message.Update:
+		if modifierOnly(msg) {
+			err = collection.UpdateId(msg.ID, modifierToUpdate(msg.Modifier))
+			if err == mgo.ErrNotFound { // it's been deleted, and the delete will be along shortly
+				err = nil
+			}
+		} else {
+			_, err = collection.UpsertId(msg.ID, msg.Document())
+		}
+	default:
+		err = collection.Insert(msg.Document())
+		if mgo.IsDup(err) {
+			err = collection.UpdateId(msg.ID, msg.Document())
+		}
+	}
+	return err
+}
+
+// targetCollection returns the collection the message should be written to
+func (m *Mongodb) targetCollection(msg *message.Msg) (*mgo.Collection, error) {
+	if m.target == nil || !m.target.dynamic() {
+		return m.mongoSession.DB(m.database).C(m.collection), nil
+	}
+
+	database, collection, err := m.target.execute(msg)
+	if err != nil {
+		return nil, err
+	}
+	return m.mongoSession.DB(database).C(collection), nil
+}
+
+// catdata pulls down the original collections, one after the other
 func (m *Mongodb) catData() (err error) {
+	collections, err := m.collectionNames()
+	if err != nil {
+		return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't list collections %s)", err.Error()), nil)
+	}
+
+	for _, name := range collections {
+		if err = m.catCollection(name); err != nil {
+			return err
+		}
+		if stop := m.pipe.Stopped; stop {
+			return
+		}
+	}
+	return
+}
+
+// catCollection pulls down one collection
+func (m *Mongodb) catCollection(name string) error {
+	if m.copyParallelism > 1 {
+		return m.catCollectionParallel(name)
+	}
+	return m.catCollectionSerial(name)
+}
+
+// catCollectionSerial pulls down one collection with a single cursor
+func (m *Mongodb) catCollectionSerial(name string) (err error) {
 	var (
-		collection = m.mongoSession.DB(m.database).C(m.collection)
-		query      = bson.M{}
+		collection = m.mongoSession.DB(m.database).C(name)
+		namespace  = m.database + "." + name
+		query      = m.query
 		result     bson.M // hold the document
+		retry      = 0
 	)
 
-	iter := collection.Find(query).Sort("_id").Iter()
+	iter := collection.Find(query).Select(projection(m.fields)).Sort("_id").Iter()
 
 	for {
 		for iter.Next(&result) {
@@ -148,9 +406,12 @@ func (m *Mongodb) catData() (err error) {
 
 			// set up the message
 			msg := message.NewMsg(message.Insert, result)
+			msg.Namespace = namespace
+			msg.Version = m.copyVersion()
 
 			m.pipe.Send(msg)
 			result = bson.M{}
+			retry = 0
 		}
 
 		// we've exited the mongo read loop, lets figure out why
@@ -159,10 +420,14 @@ func (m *Mongodb) catData() (err error) {
 			return
 		}
 
-		if iter.Err() != nil && m.restartable {
-			fmt.Printf("got err reading collection. reissuing query %v\n", iter.Err())
-			time.Sleep(1 * time.Second)
-			iter = collection.Find(query).Sort("_id").Iter()
+		if err = iter.Close(); err != nil {
+			retry++
+			if !m.restartable || !m.retries.retry(err, retry) {
+				return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (error reading collection %s %s)", namespace, err.Error()), nil)
+			}
+			fmt.Printf("got err reading collection. reissuing query %v\n", err)
+			refreshSession(m.mongoSession)
+			iter = collection.Find(query).Select(projection(m.fields)).Sort("_id").Iter()
 			continue
 		}
 
@@ -171,50 +436,36 @@ func (m *Mongodb) catData() (err error) {
 }
 
 /*
- * tail the oplog
+ * tail the oplog, starting with the first entry after m.oplogTime.
+ * entries are sent in oplog order, and each entry is sent exactly once, even when the
+ * cursor dies and has to be reissued.
  */
 func (m *Mongodb) tailData() (err error) {
 
 	var (
-		collection = m.mongoSession.DB("local").C("oplog.rs")
-		result     oplogDoc // hold the document
-		query      = bson.M{
-			"ts": bson.M{"$gte": m.oplogTime},
-			"ns": m.getNamespace(),
-		}
-
-		iter = collection.Find(query).LogReplay().Sort("$natural").Tail(m.oplogTimeout)
+		result oplogDoc // hold the document
+		iter   = m.tailOplog(m.oplogTime)
+		retry  = 0
 	)
 
+	// record where we've got to, if the sinks have flushed it by the time we exit
+	m.checkpoint()
+	defer m.saveCheckpoint()
+
 	for {
 		for iter.Next(&result) {
 			if stop := m.pipe.Stopped; stop {
 				return
 			}
-			if result.validOp() {
-				msg := message.NewMsg(message.OpTypeFromString(result.Op), nil)
-				msg.Timestamp = int64(result.Ts) >> 32
-
-				switch result.Op {
-				case "i":
-					msg.SetDocument(result.O)
-				case "d":
-					msg.SetDocument(result.O)
-				case "u":
-					doc, err := m.getOriginalDoc(result.O2)
-					if err != nil { // errors aren't fatal here, but we need to send it down the pipe
-						m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (%s)", err.Error()), nil)
-						continue
-					}
-					msg.SetDocument(doc)
-				default:
-					m.pipe.Err <- NewError(ERROR, m.path, "Mongodb error (unknown op type)", nil)
-					continue
-				}
+			if msg := m.oplogMsg(result); msg != nil {
 				m.oplogTime = result.Ts
-				m.pipe.Send(msg)
+				if m.filterOplogMsg(msg) {
+					m.pipe.Send(msg)
+				}
+				m.checkpoint()
 			}
 			result = oplogDoc{}
+			retry = 0
 		}
 
 		// we've exited the mongo read loop, lets figure out why
@@ -222,37 +473,424 @@ func (m *Mongodb) tailData() (err error) {
 		if stop := m.pipe.Stopped; stop {
 			return
 		}
+		m.checkpoint() // a quiet oplog still saves the position the sinks have flushed
 		if iter.Timeout() {
 			continue
 		}
-		if iter.Err() != nil {
-			return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (error reading collection %s)", iter.Err()), nil)
+		if err := iter.Err(); err != nil {
+			retry++
+			if !m.retries.retry(err, retry) {
+				return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (error reading collection %s)", err), nil)
+			}
+			refreshSession(m.mongoSession)
 		}
 
-		// query will change,
-		query = bson.M{
-			"ts": bson.M{"$gte": m.oplogTime},
-			"ns": m.getNamespace(),
+		// the cursor is dead, reissue the query from the last entry we sent
+		iter.Close()
+		iter = m.tailOplog(m.oplogTime)
+	}
+}
+
+// oplogMsg builds the message for an oplog entry.  returns nil for the entries we don't send, i.e.
+// no-ops, other namespaces, and the copies made when the balancer migrates a chunk between shards
+func (m *Mongodb) oplogMsg(entry oplogDoc) *message.Msg {
+	if !entry.validOp() || entry.FromMigrate || !m.matchNamespace(entry.Ns) {
+		return nil
+	}
+
+	msg := message.NewMsg(message.OpTypeFromString(entry.Op), nil)
+	msg.Timestamp = int64(entry.Ts) >> 32
+	msg.Version = int64(entry.Ts)
+	msg.Namespace = entry.Ns
+
+	switch entry.Op {
+	case "i":
+		msg.SetDocument(entry.O)
+	case "d":
+		msg.SetDocument(entry.O)
+	case "u":
+		doc, mod, err := m.updateDoc(entry)
+		if err != nil { // errors aren't fatal here, but we need to send it down the pipe
+			m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (%s)", err.Error()), nil)
+			return nil
 		}
-		iter = collection.Find(query).LogReplay().Tail(m.oplogTimeout)
+		if doc == nil { // the document's been deleted further along the oplog, and the delete will follow
+			return nil
+		}
+		msg.SetDocument(doc)
+		msg.Modifier = mod
+		msg.ModifierOnly = mod != nil && !m.fetchDocuments()
 	}
+	return msg
+}
+
+// openOplog opens a tailable cursor on the oplog for this namespace, for the entries
+// strictly after ts.  ts has already been sent, so sending it again would replay it twice
+func (m *Mongodb) openOplog(ts bson.MongoTimestamp) oplogIterator {
+	return m.oplogCursor(m.mongoSession, ts)
+}
+
+// oplogCursor opens a tailable cursor on the oplog of the replica set behind the session
+func (m *Mongodb) oplogCursor(session *mgo.Session, ts bson.MongoTimestamp) oplogIterator {
+	query := bson.M{
+		"ts": bson.M{"$gt": ts},
+		"ns": m.getNamespace(),
+	}
+	if m.collectionMatch != nil {
+		// only mongo's regex flavour is available in the query, so we narrow it down to the
+		// database here, and matchNamespace picks out the collections
+		query["ns"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(m.database+".")}
+	}
+	return session.DB("local").C("oplog.rs").Find(query).LogReplay().Sort("$natural").Tail(m.oplogTimeout)
+}
+
+// newestOplogTime returns the timestamp of the newest entry in the session's oplog.
+// this is the point that the tail replays from once the copy has finished.  using the server's
+// own timestamp rather than the local clock means clock skew can't cause us to skip entries
+func (m *Mongodb) newestOplogTime(session *mgo.Session) (bson.MongoTimestamp, error) {
+	var result oplogDoc
+
+	err := session.DB("local").C("oplog.rs").Find(nil).Sort("-$natural").One(&result)
+	if err == mgo.ErrNotFound { // an empty oplog, we'll replay all of it
+		return 0, nil
+	}
+	if err != nil {
+		return 0, NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't read the oplog %s)", err.Error()), nil)
+	}
+	return result.Ts, nil
+}
+
+// snapshotOplogTime sets the oplog time, or each shard's oplog time, to the newest entry in the oplog
+func (m *Mongodb) snapshotOplogTime() (err error) {
+	if m.shards == nil {
+		m.oplogTime, err = m.newestOplogTime(m.mongoSession)
+		return err
+	}
+	for _, shard := range m.shards {
+		if shard.oplogTime, err = m.newestOplogTime(shard.session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyVersion is the version of the copied documents.  the copy is at least as new as the oplog snapshot, and when
+// we're tailing shards, it's the oldest shard's snapshot, so every entry replayed after the copy is newer than it
+func (m *Mongodb) copyVersion() int64 {
+	if m.shards == nil {
+		return int64(m.oplogTime)
+	}
+	var version bson.MongoTimestamp
+	for i, shard := range m.shards {
+		if i == 0 || shard.oplogTime < version {
+			version = shard.oplogTime
+		}
+	}
+	return int64(version)
+}
+
+// loadCheckpoint sets the oplog time from the checkpoint store if we've been asked to resume.
+// returns true if there was a checkpoint to resume from.  each shard has its own checkpoint, and
+// we only resume when every shard has one, otherwise a shard that's been added since would be missed
+func (m *Mongodb) loadCheckpoint() (bool, error) {
+	if !m.resume {
+		return false, nil
+	}
+
+	if m.shards == nil {
+		ts, ok, err := m.loadCheckpointFor(m.path)
+		m.oplogTime = ts
+		return ok, err
+	}
+
+	for _, shard := range m.shards {
+		ts, ok, err := m.loadCheckpointFor(shard.checkpointPath(m.path))
+		if err != nil || !ok {
+			return false, err
+		}
+		shard.oplogTime = ts
+	}
+	return true, nil
+}
+
+func (m *Mongodb) loadCheckpointFor(path string) (bson.MongoTimestamp, bool, error) {
+	ts, ok, err := m.checkpoints.Load(path)
+	if err != nil {
+		return 0, false, NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't load checkpoint %s)", err.Error()), nil)
+	}
+	// when there's nothing saved yet, this is our first run
+	return bson.MongoTimestamp(ts), ok, nil
+}
+
+// an oplogCheckpoint is an oplog position, or each shard's position, waiting for the sinks to flush
+// everything sent before it
+type oplogCheckpoint struct {
+	ack       *message.Ack
+	oplogTime bson.MongoTimestamp
+	shards    []bson.MongoTimestamp
+}
+
+// checkpoint saves the pending checkpoint once the sinks have flushed it, and every checkpointInterval asks the
+// sinks to flush the current position.  nothing is saved until the sinks have written it, so after a restart
+// the entries since the last checkpoint are sent again, rather than lost from a sink's buffer
+func (m *Mongodb) checkpoint() {
+	if m.checkpoints == nil {
+		return
+	}
+	m.saveCheckpoint()
+	if m.pendingCheckpoint != nil || time.Since(m.lastCheckpoint) < checkpointInterval {
+		return
+	}
+
+	p := &oplogCheckpoint{ack: message.NewAck(), oplogTime: m.oplogTime}
+	for _, shard := range m.shards {
+		p.shards = append(p.shards, shard.oplogTime)
+	}
+	m.pendingCheckpoint = p
+	m.lastCheckpoint = time.Now()
+
+	msg := message.NewMsg(message.Command, bson.M{"flush": true})
+	msg.Ack = p.ack
+	m.pipe.Send(msg)
+}
+
+// saveCheckpoint saves the pending checkpoint to the checkpoint store, if the sinks have flushed it
+func (m *Mongodb) saveCheckpoint() {
+	p := m.pendingCheckpoint
+	if m.checkpoints == nil || p == nil {
+		return
+	}
+	select {
+	case <-p.ack.Acked():
+	default:
+		return
+	}
+	m.pendingCheckpoint = nil
+
+	var err error
+	if m.shards == nil {
+		err = m.checkpoints.Save(m.path, int64(p.oplogTime))
+	}
+	for n, shard := range m.shards {
+		if err = m.checkpoints.Save(shard.checkpointPath(m.path), int64(p.shards[n])); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (can't save checkpoint %s)", err.Error()), nil)
+	}
+}
+
+// filterOplogMsg applies the query and fields to a message read from the oplog, and returns false if it
+// shouldn't be sent.  inserts and updates are checked against the query, updates always carry the whole
+// document when there's a query.  an update whose document no longer matches becomes a delete, so that sinks
+// drop documents that have left the query.  deletes are always sent
+func (m *Mongodb) filterOplogMsg(msg *message.Msg) bool {
+	if m.query != nil && msg.Op != message.Delete {
+		matched, err := matchQuery(msg.Document(), m.query)
+		if err != nil {
+			m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (can't apply the query, %s)", err.Error()), msg.Document())
+			return false
+		}
+		if !matched {
+			if msg.Op == message.Insert {
+				return false
+			}
+			msg.Op = message.Delete
+			msg.Modifier = nil
+			msg.SetDocument(bson.M{"_id": msg.ID})
+			return true
+		}
+	}
+
+	if len(m.fields) > 0 && msg.Op != message.Delete {
+		msg.SetDocument(project(msg.Document(), m.fields))
+		msg.Modifier = projectModifier(msg.Modifier, m.fields)
+		if msg.Modifier != nil && len(msg.Modifier.Set) == 0 && len(msg.Modifier.Unset) == 0 {
+			return false // nothing we're interested in changed
+		}
+	}
+	return true
+}
+
+// updateDoc builds the document and modifier for an update entry in the oplog.  o2 holds the _id of
+// the document, and o holds either a whole replacement document or a modifier using $set and $unset.
+// modifiers are sent along with the current document, fetched from the collection, unless full_document is off and
+// there's no query to check it against, when the document only holds the _id.  the document is nil when it's
+// already been deleted
+func (m *Mongodb) updateDoc(entry oplogDoc) (bson.M, *message.Modifier, error) {
+	id, exists := entry.O2["_id"]
+	if !exists {
+		return nil, nil, fmt.Errorf("Can't get _id from document")
+	}
+
+	mod, err := parseModifier(entry.O)
+	if err != nil { // an update we don't understand, the best we can do is fetch the document
+		doc, err := m.getOriginalDoc(entry.Ns, entry.O2)
+		return doc, nil, err
+	}
+
+	if mod == nil { // a replacement document is everything we need
+		doc := entry.O
+		doc["_id"] = id
+		return doc, nil, nil
+	}
+
+	if !m.fetchDocuments() {
+		return bson.M{"_id": id}, mod, nil
+	}
+	doc, err := m.getOriginalDoc(entry.Ns, entry.O2)
+	if err == mgo.ErrNotFound {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return doc, mod, nil
+}
+
+// fetchDocuments is true when updates are sent with the whole document, because we've been asked for it, or
+// because the query needs it
+func (m *Mongodb) fetchDocuments() bool {
+	return m.fullDocument || m.query != nil
 }
 
 // getOriginalDoc retrieves the original document from the database.  transport has no knowledge of update operations, all updates
 // work as wholesale document replaces
-func (m *Mongodb) getOriginalDoc(doc bson.M) (result bson.M, err error) {
+func (m *Mongodb) getOriginalDoc(namespace string, doc bson.M) (result bson.M, err error) {
 	id, exists := doc["_id"]
 	if !exists {
 		return result, fmt.Errorf("Can't get _id from document")
 	}
 
-	err = m.mongoSession.DB(m.database).C(m.collection).FindId(id).One(&result)
+	database, collection, err := m.splitNamespace(namespace)
 	if err != nil {
-		err = fmt.Errorf("%s %v %v", m.getNamespace(), id, err)
+		return result, err
+	}
+
+	err = m.mongoSession.DB(database).C(collection).FindId(id).One(&result)
+	if err != nil && err != mgo.ErrNotFound {
+		err = fmt.Errorf("%s %v %v", namespace, id, err)
 	}
 	return
 }
 
+// parseModifier turns the o field of an update oplog entry into a message.Modifier.
+// returns nil if the entry holds a whole replacement document rather than a modifier
+func parseModifier(o bson.M) (*message.Modifier, error) {
+	var (
+		mod        = &message.Modifier{}
+		isModifier = false
+	)
+	for k, v := range o {
+		if !strings.HasPrefix(k, "$") {
+			continue
+		}
+		isModifier = true
+
+		switch k {
+		case "$set":
+			set, ok := v.(bson.M)
+			if !ok {
+				return nil, fmt.Errorf("malformed $set (%v)", v)
+			}
+			mod.Set = set
+		case "$unset":
+			unset, ok := v.(bson.M)
+			if !ok {
+				return nil, fmt.Errorf("malformed $unset (%v)", v)
+			}
+			for field := range unset {
+				mod.Unset = append(mod.Unset, field)
+			}
+			sort.Strings(mod.Unset)
+		case "$v": // the version of the oplog update format
+		default:
+			return nil, fmt.Errorf("unsupported update operator %s", k)
+		}
+	}
+
+	if !isModifier {
+		return nil, nil
+	}
+	return mod, nil
+}
+
+// modifierOnly is true for update messages that carry a modifier, but not the whole document
+func modifierOnly(msg *message.Msg) bool {
+	return msg.Op == message.Update && msg.Modifier != nil && msg.ModifierOnly
+}
+
+// errModifierOnly is reported by sinks that can only write whole documents when they're sent an update that only
+// carries a modifier.  the update is dropped, rather than replacing the document with its _id
+var errModifierOnly = errors.New("an update that only carries a modifier can't be applied, the source needs full_document")
+
+// modifierToUpdate turns a message.Modifier back into a mongo update document
+func modifierToUpdate(mod *message.Modifier) bson.M {
+	update := bson.M{}
+	if len(mod.Set) > 0 {
+		update["$set"] = mod.Set
+	}
+	if len(mod.Unset) > 0 {
+		unset := bson.M{}
+		for _, field := range mod.Unset {
+			unset[field] = ""
+		}
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// collectionNames returns the names of the collections to copy, in order
+func (m *Mongodb) collectionNames() ([]string, error) {
+	if m.collectionMatch == nil {
+		return []string{m.collection}, nil
+	}
+
+	names, err := m.mongoSession.DB(m.database).CollectionNames()
+	if err != nil {
+		return nil, err
+	}
+
+	collections := make([]string, 0, len(names))
+	for _, name := range names {
+		if m.matchNamespace(m.database + "." + name) {
+			collections = append(collections, name)
+		}
+	}
+	return collections, nil
+}
+
+// matchNamespace checks whether the namespace is one that this adaptor reads from.
+// system collections never match
+func (m *Mongodb) matchNamespace(namespace string) bool {
+	database, collection, err := m.splitNamespace(namespace)
+	if err != nil || database != m.database || strings.HasPrefix(collection, "system.") {
+		return false
+	}
+
+	if m.collectionMatch == nil {
+		return collection == m.collection
+	}
+	return m.collectionMatch.MatchString(collection)
+}
+
+// parseCollectionMatch parses the collection half of a namespace.  "*" matches every collection, and
+// a collection wrapped in slashes, like /^events_\d+$/, is a regular expression.
+// returns nil for the name of a single collection
+func parseCollectionMatch(collection string) (*regexp.Regexp, error) {
+	if collection == "*" {
+		return regexp.Compile(".*")
+	}
+	if len(collection) > 1 && strings.HasPrefix(collection, "/") && strings.HasSuffix(collection, "/") {
+		re, err := regexp.Compile(collection[1 : len(collection)-1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed mongo namespace (%s)", err.Error())
+		}
+		return re, nil
+	}
+	return nil, nil
+}
+
 func (m *Mongodb) getNamespace() string {
 	return strings.Join([]string{m.database, m.collection}, ".")
 }
@@ -277,11 +915,20 @@ type oplogDoc struct {
 	Ns string              `bson:"ns"`
 	O  bson.M              `bson:"o"`
 	O2 bson.M              `bson:"o2"`
+
+	FromMigrate bool `bson:"fromMigrate"` // written by a chunk migration, not by a client
+}
+
+// oplogIterator is the subset of *mgo.Iter used to read the oplog
+type oplogIterator interface {
+	Next(result interface{}) bool
+	Timeout() bool
+	Err() error
+	Close() error
 }
 
 // validOp checks to see if we're an insert, delete, or update, otherwise the
 // document is skilled.
-// TODO: skip system collections
 func (o *oplogDoc) validOp() bool {
 	return o.Op == "i" || o.Op == "d" || o.Op == "u"
 }
@@ -289,16 +936,90 @@ func (o *oplogDoc) validOp() bool {
 // MongodbConfig provides configuration options for a mongodb adaptor
 // the notable difference between this and dbConfig is the presence of the Tail option
 type MongodbConfig struct {
-	URI       string `json:"uri"`
+	URI string `json:"uri"`
+
+	// connection options.  SSL dials the servers over tls, checking their certificates against CAFile,
+	// and presenting the client certificate in CertFile and KeyFile if they're given.
+	// AuthSource and AuthMechanism (i.e. SCRAM-SHA-1, MONGODB-X509) override the uri's authSource and
+	// authMechanism, and Timeout is how long to wait for a connection, i.e. "30s"
+	SSL           bool   `json:"ssl"`
+	CAFile        string `json:"ca_file"`
+	CertFile      string `json:"cert_file"`
+	KeyFile       string `json:"key_file"`
+	AuthSource    string `json:"auth_source"`
+	AuthMechanism string `json:"auth_mechanism"`
+	Timeout       string `json:"timeout"`
+
+	// Namespace is the db.collection to read from or write to.  sources can read from more than one
+	// collection at a time, with either db.* for every collection in db, or a regular expression
+	// wrapped in slashes, db./^events_\d+$/.  sinks can use a template to write each message
+	// somewhere different, i.e. {db}_copy.{collection}
 	Namespace string `json:"namespace"`
 	Debug     bool   `json:"debug"`
-	Tail      bool   `json:"tail"`
-}
 
-func nowAsMongoTimestamp() bson.MongoTimestamp {
-	return bson.MongoTimestamp(time.Now().Unix() << 32)
+	// Tail copies the collection and then tails the oplog.  the oplog position is read before
+	// the copy starts, and the tail replays every entry after it, in order, so changes made while the copy was
+	// running are applied after it finishes and nothing is lost between the copy and the tail
+	Tail bool `json:"tail"`
+
+	// Resume skips the initial copy and tails the oplog from the last saved checkpoint.
+	// if there is no checkpoint, the collection is copied as usual.  Resume implies Tail
+	Resume bool `json:"resume"`
+
+	// FullDocument fetches the current version of the document for each update in the oplog, and sends it
+	// along with the update's modifier.  it's on by default.  turning it off saves a query per update, but the
+	// updates then only carry their modifier, which only sinks with Modifiers set, or elasticsearch with
+	// partial_updates, can apply
+	FullDocument *bool `json:"full_document"`
+
+	// Modifiers lets the sink apply updates that only carry a modifier, from a source with full_document off,
+	// with $set and $unset.  without it, those updates are reported as errors
+	Modifiers bool `json:"modifiers"`
+
+	// CopyParallelism splits each collection into this many ranges by _id, and copies the ranges concurrently.
+	// collections are copied with a single cursor when this is 0 or 1
+	CopyParallelism int `json:"copy_parallelism"`
+
+	// Query limits the documents read by the source.  it's a mongo query, either as a document or as a json string,
+	// and can use extended json, i.e. {"_id": {"$oid": "..."}}.  the query is also applied to the oplog, so it can
+	// only use what can be checked there: values, $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $and, $or, $nor
+	// and dotted fields.  updates are checked against the whole document, which is fetched even when full_document is off
+	Query interface{} `json:"query"`
+
+	// Fields limits the fields read by the source, the _id is always included
+	Fields []string `json:"fields"`
+
+	// BulkSize buffers up to this many writes, and applies them together with a bulk write.
+	// writes are applied one at a time when this is 0 or 1
+	BulkSize int `json:"bulk_size"`
+
+	// FlushInterval is the longest that buffered writes wait before they're applied, i.e. "500ms"
+	FlushInterval string `json:"flush_interval"`
+
+	// WriteConcern is how many members of the replica set have to acknowledge the sink's writes, or the name of a mode,
+	// i.e. "majority".  0 doesn't wait for an acknowledgement.  Journal waits for writes to reach the journal
+	WriteConcern interface{} `json:"write_concern"`
+	Journal      bool        `json:"journal"`
+
+	// ReadPreference is which members the source reads from, one of primary (the default), primaryPreferred,
+	// secondary, secondaryPreferred or nearest
+	ReadPreference string `json:"read_preference"`
+
+	// MaxRetries is how many times an operation that failed with a network error, or while the primary was changing,
+	// is tried again before giving up, 5 by default and never when it's negative.  RetryBackoff is the wait before the
+	// first retry, i.e. "500ms", and it doubles after every retry, up to a minute
+	MaxRetries   int    `json:"max_retries"`
+	RetryBackoff string `json:"retry_backoff"`
+
+	// Checkpoint is the uri of the store used to record the oplog position, i.e. file:///var/lib/transporter/state.
+	// defaults to state.DefaultURI when Resume is set.  a position is only saved once the sinks have flushed the
+	// entries before it, so entries can be sent again after a restart, but none are lost
+	Checkpoint string `json:"checkpoint"`
 }
 
+// how often the sinks are asked to flush, so that the oplog position can be written to the checkpoint store
+const checkpointInterval = 1 * time.Second
+
 func newMongoTimestamp(s, i int) bson.MongoTimestamp {
 	return bson.MongoTimestamp(int64(s)<<32 + int64(i))
 }
@@ -0,0 +1,73 @@
+package adaptor
+
+import (
+	"fmt"
+
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// a mongoWrite is a message buffered for a bulk write, and the collection it's written to
+type mongoWrite struct {
+	collection *mgo.Collection
+	msg        *message.Msg
+}
+
+// writeBulk applies a namespace's buffered writes with mgo's Bulk api.  bulks are ordered, so the operations on
+// a collection are always applied in the order they arrived
+func (m *Mongodb) writeBulk(namespace string, items []interface{}) {
+	msgs := make([]*message.Msg, len(items))
+	for i, item := range items {
+		msgs[i] = item.(mongoWrite).msg
+	}
+	m.runBulk(items[0].(mongoWrite).collection, msgs)
+}
+
+// runBulk applies the messages to the collection.  an ordered bulk stops at the first failure, so
+// we report the failed message, and run again with the messages that came after it.
+// transient failures are retried, the writes are all idempotent so the ones that made it can be applied again
+func (m *Mongodb) runBulk(collection *mgo.Collection, msgs []*message.Msg) {
+	for len(msgs) > 0 {
+		err := m.retries.do(collection.Database.Session, func() error {
+			bulk := collection.Bulk()
+			for _, msg := range msgs {
+				addToBulk(bulk, msg)
+			}
+			_, err := bulk.Run()
+			return err
+		})
+		if err == nil {
+			return
+		}
+
+		berr, ok := err.(*mgo.BulkError)
+		if !ok || len(berr.Cases()) == 0 || berr.Cases()[0].Index < 0 || berr.Cases()[0].Index >= len(msgs) {
+			m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (bulk write of %d documents to %s failed, %s)", len(msgs), collection.FullName, err.Error()), nil)
+			return
+		}
+
+		failed := berr.Cases()[0]
+		m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (%s)", failed.Err.Error()), msgs[failed.Index].Document())
+		msgs = msgs[failed.Index+1:]
+	}
+}
+
+// addToBulk queues the operation for one message.  inserts are upserts, so that a document that's
+// already there is replaced, the same as it is when writing one message at a time
+func addToBulk(bulk *mgo.Bulk, msg *message.Msg) {
+	selector := bson.M{"_id": msg.ID}
+
+	switch msg.Op {
+	case message.Delete:
+		bulk.Remove(selector)
+	case message.Update:
+		if modifierOnly(msg) {
+			bulk.Update(selector, modifierToUpdate(msg.Modifier))
+		} else {
+			bulk.Upsert(selector, msg.Document())
+		}
+	default:
+		bulk.Upsert(selector, msg.Document())
+	}
+}
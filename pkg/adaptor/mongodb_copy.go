@@ -0,0 +1,291 @@
+package adaptor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/compose/transporter/pkg/events"
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// how often each range reports its progress while copying in parallel
+const rangeProgressEvery = 10000
+
+// bson type numbers, used with $type
+const (
+	bsonString   = 2
+	bsonObjectID = 7
+)
+
+// the bson types an _id can hold, in mongo's sort order.  arrays can't be _ids, and mgo can't read decimals
+var idTypes = []int{-1, 10, 1, 16, 18, 14, 2, 3, 5, 7, 8, 9, 17, 11, 127}
+
+// an idRange is a slice of a collection, split on _id, that's copied by its own cursor.
+// ranges hold the _ids of one bson type, and if the copy fails part way through, the range is
+// reissued from the last _id that was sent.  a range with wholeType set holds every _id of its type,
+// and picks up the _ids of the types the collection wasn't split on
+type idRange struct {
+	name      string
+	min, max  interface{} // the bounds of the range, nil when the range is open at that end
+	bsonType  int         // the bson type of the _ids in the range
+	wholeType bool        // the range holds every _id of bsonType
+	last      interface{} // the last _id that was sent
+	count     int
+}
+
+// selector returns the query for the documents in the range that haven't been sent yet.  mongo only
+// compares values of the same type, and $type is bounded by the index, so no range scans the whole collection
+func (r *idRange) selector() bson.M {
+	cond := bson.M{}
+	if r.wholeType {
+		cond["$type"] = r.bsonType
+	}
+	switch {
+	case r.last != nil:
+		cond["$gt"] = r.last
+	case r.min != nil:
+		cond["$gte"] = r.min
+	}
+	if r.max != nil {
+		cond["$lt"] = r.max
+	}
+	return bson.M{"_id": cond}
+}
+
+// buildRanges turns the split points into ranges that, between them, cover every document once.
+// mongo only compares values of the same type, so the points all have to be one type.  when the collection
+// has _ids of other types, mixed is set and there's one more range for each of them.  returns nil if the
+// points can't be used
+func buildRanges(points []interface{}, mixed bool) []*idRange {
+	bsonType := splitPointType(points)
+	if bsonType == 0 {
+		return nil
+	}
+
+	ranges := make([]*idRange, 0, len(points)+2)
+	var min interface{}
+	for _, point := range points {
+		if point == min { // sampling can land on the same _id twice
+			continue
+		}
+		i := len(ranges)
+		ranges = append(ranges, &idRange{name: fmt.Sprintf("%d", i), min: min, max: point, bsonType: bsonType})
+		min = point
+	}
+	ranges = append(ranges, &idRange{name: fmt.Sprintf("%d", len(ranges)), min: min, bsonType: bsonType})
+	if !mixed {
+		return ranges
+	}
+	for _, t := range idTypes {
+		if t != bsonType {
+			ranges = append(ranges, &idRange{name: fmt.Sprintf("type%d", t), bsonType: t, wholeType: true})
+		}
+	}
+	return ranges
+}
+
+// splitPointType returns the bson type shared by all the points, 0 if they don't share one, or it's a type
+// we don't split on.  numbers aren't split on, since mongo compares ints, longs and doubles with each other
+func splitPointType(points []interface{}) int {
+	bsonType := 0
+	for _, point := range points {
+		t := splitType(point)
+		if t == 0 || (bsonType != 0 && t != bsonType) {
+			return 0
+		}
+		bsonType = t
+	}
+	return bsonType
+}
+
+// splitType is the bson type of an _id we can split on, or 0 for the other types
+func splitType(id interface{}) int {
+	switch id.(type) {
+	case bson.ObjectId:
+		return bsonObjectID
+	case string:
+		return bsonString
+	}
+	return 0
+}
+
+// mixedIDs is true when the collection has _ids that aren't bsonType.  the _id index is sorted by type
+// first, so it's enough to look at both ends of it
+func mixedIDs(collection *mgo.Collection, bsonType int) (bool, error) {
+	for _, sort := range []string{"_id", "-_id"} {
+		var doc bson.M
+		err := collection.Find(nil).Select(bson.M{"_id": 1}).Sort(sort).One(&doc)
+		if err == mgo.ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if splitType(doc["_id"]) != bsonType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// catCollectionParallel splits the collection into ranges by _id and copies the ranges concurrently,
+// each with its own cursor.  collections that can't be split are copied one document at a time
+func (m *Mongodb) catCollectionParallel(name string) error {
+	var (
+		collection = m.mongoSession.DB(m.database).C(name)
+		namespace  = m.database + "." + name
+	)
+
+	points, err := m.splitPoints(collection, m.copyParallelism)
+	if err != nil {
+		return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't split %s %s)", namespace, err.Error()), nil)
+	}
+	bsonType := splitPointType(points)
+	if bsonType == 0 {
+		return m.catCollectionSerial(name)
+	}
+	mixed, err := mixedIDs(collection, bsonType)
+	if err != nil {
+		return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't split %s %s)", namespace, err.Error()), nil)
+	}
+	ranges := buildRanges(points, mixed)
+
+	var (
+		out  = make(chan *message.Msg)
+		errs = make(chan error, len(ranges))
+		wg   sync.WaitGroup
+	)
+	for _, r := range ranges {
+		wg.Add(1)
+		go func(r *idRange) {
+			defer wg.Done()
+			if err := m.copyRange(name, namespace, r, out); err != nil {
+				errs <- err
+			}
+		}(r)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+		close(errs)
+	}()
+
+	// pipe.Send isn't safe to call from more than one goroutine, so everything goes out from here
+	for msg := range out {
+		m.pipe.Send(msg)
+	}
+	return <-errs
+}
+
+// copyRange reads every document in the range onto out, with its own copy of the session, so that a range
+// that fails doesn't disturb the others.  when the cursor fails, the range is reissued from the last document it sent
+func (m *Mongodb) copyRange(name, namespace string, r *idRange, out chan *message.Msg) error {
+	var (
+		result     bson.M
+		path       = fmt.Sprintf("%s/%s/%s", m.path, namespace, r.name)
+		retry      = 0
+		session    = m.mongoSession.Copy()
+		collection = session.DB(m.database).C(name)
+	)
+	defer session.Close()
+
+	for {
+		query := r.selector()
+		if m.query != nil {
+			query = bson.M{"$and": []interface{}{m.query, query}}
+		}
+
+		iter := collection.Find(query).Select(projection(m.fields)).Sort("_id").Iter()
+		for iter.Next(&result) {
+			if stop := m.pipe.Stopped; stop {
+				iter.Close()
+				return nil
+			}
+			r.last = result["_id"]
+
+			msg := message.NewMsg(message.Insert, result)
+			msg.Namespace = namespace
+			msg.Version = m.copyVersion()
+			out <- msg
+			result = bson.M{}
+
+			r.count++
+			retry = 0
+			if r.count%rangeProgressEvery == 0 {
+				m.pipe.Event <- events.NewMetricsEvent(time.Now().Unix(), path, r.count)
+			}
+		}
+
+		if stop := m.pipe.Stopped; stop {
+			return nil
+		}
+
+		if err := iter.Close(); err != nil {
+			retry++
+			if !m.restartable || !m.retries.retry(err, retry) {
+				return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (error reading %s %s)", path, err.Error()), nil)
+			}
+			fmt.Printf("got err reading range %s. reissuing query %v\n", path, err)
+			refreshSession(session)
+			continue
+		}
+
+		m.pipe.Event <- events.NewMetricsEvent(time.Now().Unix(), path, r.count)
+		return nil
+	}
+}
+
+// splitPoints returns up to n-1 _ids that split the collection into n ranges of about the same size.
+// the points come from splitVector when the server lets us run it, and otherwise they're sampled
+// by skipping through the _id index
+func (m *Mongodb) splitPoints(collection *mgo.Collection, n int) ([]interface{}, error) {
+	var stats struct {
+		Count int `bson:"count"`
+		Size  int `bson:"size"`
+	}
+	if err := collection.Database.Run(bson.D{{Name: "collStats", Value: collection.Name}}, &stats); err != nil {
+		return nil, err
+	}
+	if stats.Count < n {
+		return nil, nil
+	}
+
+	var result struct {
+		SplitKeys []bson.M `bson:"splitKeys"`
+	}
+	err := collection.Database.Run(bson.D{
+		{Name: "splitVector", Value: collection.FullName},
+		{Name: "keyPattern", Value: bson.M{"_id": 1}},
+		{Name: "maxChunkSizeBytes", Value: stats.Size/n + 1},
+	}, &result)
+	if err == nil && len(result.SplitKeys) > 0 {
+		points := make([]interface{}, 0, n-1)
+		step := float64(len(result.SplitKeys)+1) / float64(n)
+		for i := 1; i < n; i++ {
+			idx := int(float64(i)*step) - 1
+			if idx < 0 || idx >= len(result.SplitKeys) {
+				continue
+			}
+			points = append(points, result.SplitKeys[idx]["_id"])
+		}
+		return points, nil
+	}
+
+	// no splitVector, sample the boundaries instead
+	points := make([]interface{}, 0, n-1)
+	for i := 1; i < n; i++ {
+		var doc bson.M
+		err := collection.Find(nil).Select(bson.M{"_id": 1}).Sort("_id").Skip(i * stats.Count / n).Limit(1).One(&doc)
+		if err == mgo.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, doc["_id"])
+	}
+	return points, nil
+}
@@ -0,0 +1,162 @@
+package adaptor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// how long to wait for a connection when the config doesn't say
+const defaultMongoTimeout = 10 * time.Second
+
+// mongoDialInfo builds the mgo.DialInfo for the config.  the uri is parsed by mgo, and the config's
+// auth options are layered on top.  when ssl is set, either in the config or with ssl=true in the uri,
+// servers are dialed over tls
+func mongoDialInfo(conf MongodbConfig) (*mgo.DialInfo, error) {
+	uri, ssl, err := stripSSLOption(conf.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := mgo.ParseURL(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Timeout = defaultMongoTimeout
+	if conf.Timeout != "" {
+		if info.Timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+			return nil, fmt.Errorf("malformed timeout (%s)", err.Error())
+		}
+	}
+	if conf.AuthSource != "" {
+		info.Source = conf.AuthSource
+	}
+	if conf.AuthMechanism != "" {
+		info.Mechanism = conf.AuthMechanism
+	}
+
+	if ssl || conf.SSL {
+		dial, err := tlsDialer(conf, info.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return dial(addr.String())
+		}
+	}
+	return info, nil
+}
+
+// stripSSLOption removes the ssl option from the uri, since mgo doesn't understand it, and
+// returns whether it was set
+func stripSSLOption(uri string) (string, bool, error) {
+	i := strings.Index(uri, "?")
+	if i < 0 {
+		return uri, false, nil
+	}
+
+	options, err := url.ParseQuery(uri[i+1:])
+	if err != nil {
+		return uri, false, fmt.Errorf("malformed uri options (%s)", err.Error())
+	}
+	ssl := options.Get("ssl") == "true"
+	options.Del("ssl")
+
+	if len(options) == 0 {
+		return uri[:i], ssl, nil
+	}
+	return uri[:i] + "?" + options.Encode(), ssl, nil
+}
+
+// tlsDialer returns a function that dials a server over tls.  the server's certificate is
+// checked against ca_file if it's given, and the system's roots if it isn't.  cert_file and key_file
+// are the client certificate, used for x.509 auth, or by servers that require a client certificate
+func tlsDialer(conf MongodbConfig, timeout time.Duration) (func(addr string) (net.Conn, error), error) {
+	tlsConfig := &tls.Config{}
+
+	if conf.CAFile != "" {
+		ca, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read ca_file (%s)", err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("can't read ca_file (no certificates found in %s)", conf.CAFile)
+		}
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		keyFile := conf.KeyFile
+		if keyFile == "" { // the key is often in the same pem as the certificate
+			keyFile = conf.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read cert_file / key_file (%s)", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return func(addr string) (net.Conn, error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, tlsConfig)
+	}, nil
+}
+
+// mongoSafe builds the sink's write concern from the write_concern and journal options.  write_concern is either
+// the number of members that have to acknowledge a write, or the name of a mode, i.e. "majority".  nil leaves
+// mgo's default, an acknowledged write, and a write_concern of 0 doesn't wait for an acknowledgement at all
+func mongoSafe(conf MongodbConfig) (*mgo.Safe, bool, error) {
+	safe := &mgo.Safe{J: conf.Journal}
+
+	switch w := conf.WriteConcern.(type) {
+	case nil:
+		if !conf.Journal {
+			return nil, false, nil
+		}
+	case float64:
+		if w != float64(int(w)) || w < 0 {
+			return nil, false, fmt.Errorf("malformed write_concern (%v)", w)
+		}
+		if w == 0 && !conf.Journal {
+			return nil, true, nil // unacknowledged
+		}
+		safe.W = int(w)
+	case string:
+		if w == "" {
+			return nil, false, fmt.Errorf("malformed write_concern (empty)")
+		}
+		safe.WMode = w
+	default:
+		return nil, false, fmt.Errorf("malformed write_concern, expected a number or a string (got %T)", w)
+	}
+	return safe, true, nil
+}
+
+// readModes are the read_preference options, and the mgo modes they map to
+var readModes = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// readMode returns the mgo mode for the read_preference option, primary when it isn't set
+func readMode(preference string) (mgo.Mode, error) {
+	if preference == "" {
+		return mgo.Primary, nil
+	}
+	mode, ok := readModes[preference]
+	if !ok {
+		return mgo.Primary, fmt.Errorf("unknown read_preference %s", preference)
+	}
+	return mode, nil
+}
@@ -0,0 +1,224 @@
+package adaptor
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestMongoDialInfo(t *testing.T) {
+	data := []struct {
+		conf      MongodbConfig
+		addrs     []string
+		source    string
+		mechanism string
+		timeout   time.Duration
+		tls       bool
+	}{
+		{
+			MongodbConfig{URI: "mongodb://localhost/boom"},
+			[]string{"localhost"}, "", "", defaultMongoTimeout, false,
+		},
+		{
+			MongodbConfig{URI: "mongodb://a:27017,b:27017/boom?ssl=true&authSource=admin", Timeout: "30s"},
+			[]string{"a:27017", "b:27017"}, "admin", "", 30 * time.Second, true,
+		},
+		{
+			MongodbConfig{URI: "mongodb://localhost/boom?authSource=admin", SSL: true, AuthSource: "$external", AuthMechanism: "MONGODB-X509"},
+			[]string{"localhost"}, "$external", "MONGODB-X509", defaultMongoTimeout, true,
+		},
+	}
+
+	for _, v := range data {
+		info, err := mongoDialInfo(v.conf)
+		if err != nil {
+			t.Errorf("%s: got error %s", v.conf.URI, err)
+			continue
+		}
+		if len(info.Addrs) != len(v.addrs) || info.Addrs[0] != v.addrs[0] {
+			t.Errorf("%s: expected addrs %v, got %v", v.conf.URI, v.addrs, info.Addrs)
+		}
+		if info.Source != v.source || info.Mechanism != v.mechanism || info.Timeout != v.timeout {
+			t.Errorf("%s: expected source %s, mechanism %s, timeout %s, got %s, %s, %s", v.conf.URI,
+				v.source, v.mechanism, v.timeout, info.Source, info.Mechanism, info.Timeout)
+		}
+		if (info.DialServer != nil) != v.tls {
+			t.Errorf("%s: expected tls to be %v", v.conf.URI, v.tls)
+		}
+	}
+
+	if _, err := mongoDialInfo(MongodbConfig{URI: "mongodb://localhost/boom", Timeout: "soon"}); err == nil {
+		t.Errorf("expected an error for a malformed timeout")
+	}
+}
+
+// TestTLSDialer dials a local tls server, standing in for mongod --sslMode requireSSL --sslCAFile,
+// that only accepts clients with a certificate signed by its ca
+func TestTLSDialer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transporter-tls")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newCert(t, "ca", nil, nil)
+	server, serverKey := newCert(t, "127.0.0.1", ca, caKey)
+	client, clientKey := newCert(t, "transporter", ca, caKey)
+
+	caFile := writePEM(t, dir, "ca.pem", ca, nil)
+	certFile := writePEM(t, dir, "client.pem", client, clientKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer ln.Close()
+
+	peers := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			peers <- ""
+			return
+		}
+		peers <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}()
+
+	dial, err := tlsDialer(MongodbConfig{SSL: true, CAFile: caFile, CertFile: certFile}, time.Second)
+	if err != nil {
+		t.Fatalf("can't create dialer: %s", err)
+	}
+	conn, err := dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("can't dial: %s", err)
+	}
+	defer conn.Close()
+
+	if peer := <-peers; peer != "transporter" {
+		t.Errorf("expected the server to see the client certificate, got %q", peer)
+	}
+
+	// without the ca, the server's certificate can't be verified
+	dial, _ = tlsDialer(MongodbConfig{SSL: true, CertFile: certFile}, time.Second)
+	if conn, err := dial(ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("expected an error dialing a server we can't verify")
+	}
+
+	if _, err := tlsDialer(MongodbConfig{SSL: true, CAFile: filepath.Join(dir, "missing.pem")}, time.Second); err == nil {
+		t.Errorf("expected an error for a missing ca_file")
+	}
+}
+
+// newCert creates a certificate for name, signed by parent, or self signed when parent is nil
+func newCert(t *testing.T, name string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("can't generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("can't create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("can't parse certificate: %s", err)
+	}
+	return cert, key
+}
+
+// writePEM writes the certificate, and the key if there is one, to a pem file
+func writePEM(t *testing.T, dir, name string, cert *x509.Certificate, key *rsa.PrivateKey) string {
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if key != nil {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	}
+
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, out, 0600); err != nil {
+		t.Fatalf("can't write %s: %s", name, err)
+	}
+	return filename
+}
+
+func TestMongoSafe(t *testing.T) {
+	data := []struct {
+		conf MongodbConfig
+		safe *mgo.Safe
+		set  bool
+		err  bool
+	}{
+		{MongodbConfig{}, nil, false, false},
+		{MongodbConfig{WriteConcern: float64(0)}, nil, true, false},
+		{MongodbConfig{WriteConcern: float64(2)}, &mgo.Safe{W: 2}, true, false},
+		{MongodbConfig{WriteConcern: "majority", Journal: true}, &mgo.Safe{WMode: "majority", J: true}, true, false},
+		{MongodbConfig{Journal: true}, &mgo.Safe{J: true}, true, false},
+		{MongodbConfig{WriteConcern: float64(1.5)}, nil, false, true},
+		{MongodbConfig{WriteConcern: true}, nil, false, true},
+	}
+
+	for _, v := range data {
+		safe, set, err := mongoSafe(v.conf)
+		if (err != nil) != v.err {
+			t.Errorf("%v: expected error to be %v, got %v", v.conf.WriteConcern, v.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(safe, v.safe) || set != v.set {
+			t.Errorf("%v: expected %+v %v, got %+v %v", v.conf.WriteConcern, v.safe, v.set, safe, set)
+		}
+	}
+}
+
+func TestReadMode(t *testing.T) {
+	if mode, err := readMode(""); err != nil || mode != mgo.Primary {
+		t.Errorf("expected primary by default, got %v %v", mode, err)
+	}
+	if mode, err := readMode("secondaryPreferred"); err != nil || mode != mgo.SecondaryPreferred {
+		t.Errorf("expected secondaryPreferred, got %v %v", mode, err)
+	}
+	if _, err := readMode("anywhere"); err == nil {
+		t.Errorf("expected an error for an unknown read_preference")
+	}
+}
@@ -0,0 +1,423 @@
+package adaptor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/compose/mejson"
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errUnsupportedQuery is returned by matchQuery when the query uses something it can't evaluate
+var errUnsupportedQuery = errors.New("unsupported query")
+
+// parseQuery turns the query option into a bson query.  the option is either a document, or a string
+// holding a json document, and either way it can use mongo extended json, i.e. {"_id": {"$oid": "..."}}
+func parseQuery(in interface{}) (bson.M, error) {
+	var raw map[string]interface{}
+	switch q := in.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if q == "" {
+			return nil, nil
+		}
+		if err := json.Unmarshal([]byte(q), &raw); err != nil {
+			return nil, fmt.Errorf("malformed query (%s)", err.Error())
+		}
+	case map[string]interface{}:
+		raw = q
+	default:
+		return nil, fmt.Errorf("malformed query, expected a document (got %T)", in)
+	}
+
+	query, err := mejson.Unmarshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("malformed query (%s)", err.Error())
+	}
+	return bson.M(query), nil
+}
+
+// projection turns a list of fields into a mongo projection, nil if there are no fields
+func projection(fields []string) bson.M {
+	if len(fields) == 0 {
+		return nil
+	}
+	p := bson.M{}
+	for _, field := range fields {
+		p[field] = 1
+	}
+	return p
+}
+
+// project keeps the listed fields of the document, along with the _id, and drops the rest
+func project(doc bson.M, fields []string) bson.M {
+	if len(fields) == 0 {
+		return doc
+	}
+	out := bson.M{}
+	if id, ok := doc["_id"]; ok {
+		out["_id"] = id
+	}
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		if value, ok := lookupField(doc, field); ok {
+			setField(out, path, value)
+		}
+	}
+	return out
+}
+
+// setField sets the value at path, creating nested documents as needed
+func setField(doc bson.M, path []string, value interface{}) {
+	for _, field := range path[:len(path)-1] {
+		next, ok := doc[field].(bson.M)
+		if !ok {
+			next = bson.M{}
+			doc[field] = next
+		}
+		doc = next
+	}
+	doc[path[len(path)-1]] = value
+}
+
+// projectModifier drops the parts of the modifier that touch fields outside the projection.  a field that's set to a
+// document holding projected fields, i.e. address under address.city, is trimmed down to them, and a field that's set
+// to anything else holds none of them, so it's unset
+func projectModifier(mod *message.Modifier, fields []string) *message.Modifier {
+	if len(fields) == 0 || mod == nil {
+		return mod
+	}
+	out := &message.Modifier{}
+	for field, value := range mod.Set {
+		if !inProjection(field, fields) {
+			continue
+		}
+		if subfields := projectedSubfields(field, fields); len(subfields) > 0 {
+			doc, ok := asDocument(value)
+			if !ok {
+				out.Unset = append(out.Unset, field)
+				continue
+			}
+			value = projectSubdocument(doc, subfields)
+		}
+		if out.Set == nil {
+			out.Set = bson.M{}
+		}
+		out.Set[field] = value
+	}
+	for _, field := range mod.Unset {
+		if inProjection(field, fields) {
+			out.Unset = append(out.Unset, field)
+		}
+	}
+	return out
+}
+
+// projectedSubfields is the part of each projected field under the field, i.e. city for address.city under address.
+// it's empty when the field is projected as a whole
+func projectedSubfields(field string, fields []string) []string {
+	var subfields []string
+	for _, f := range fields {
+		if field == f || strings.HasPrefix(field, f+".") {
+			return nil
+		}
+		if strings.HasPrefix(f, field+".") {
+			subfields = append(subfields, strings.TrimPrefix(f, field+"."))
+		}
+	}
+	return subfields
+}
+
+// projectSubdocument is project for a document nested in another, which only keeps its _id when it's projected
+func projectSubdocument(doc bson.M, fields []string) bson.M {
+	out := project(doc, fields)
+	for _, f := range fields {
+		if f == "_id" {
+			return out
+		}
+	}
+	delete(out, "_id")
+	return out
+}
+
+// inProjection is true if the field, or part of it, is in the projection
+func inProjection(field string, fields []string) bool {
+	for _, f := range fields {
+		if field == f || strings.HasPrefix(field, f+".") || strings.HasPrefix(f, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkQuery returns an error naming the first operator in the query that matchQuery can't evaluate, so that
+// a query the oplog can't be filtered with is refused up front rather than let through
+func checkQuery(query bson.M) error {
+	for key, cond := range query {
+		switch key {
+		case "$and", "$or", "$nor":
+			clauses, ok := cond.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s needs a list of queries", key)
+			}
+			for _, clause := range clauses {
+				q, ok := asDocument(clause)
+				if !ok {
+					return fmt.Errorf("%s needs a list of queries", key)
+				}
+				if err := checkQuery(q); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			return fmt.Errorf("%s isn't supported", key)
+		}
+
+		ops, isDoc := asDocument(cond)
+		if !isDoc || !hasOperators(ops) {
+			continue
+		}
+		for op, arg := range ops {
+			switch op {
+			case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			case "$in", "$nin":
+				if _, ok := arg.([]interface{}); !ok {
+					return fmt.Errorf("%s needs a list", op)
+				}
+			case "$exists":
+				if _, ok := arg.(bool); !ok {
+					return fmt.Errorf("$exists needs true or false")
+				}
+			default:
+				return fmt.Errorf("%s isn't supported", op)
+			}
+		}
+	}
+	return nil
+}
+
+// matchQuery checks a document against a mongo query.  it understands equality, comparisons,
+// $in / $nin, $exists, $and / $or / $nor and dotted field paths, and returns errUnsupportedQuery
+// for anything else
+func matchQuery(doc bson.M, query bson.M) (bool, error) {
+	for key, cond := range query {
+		var (
+			ok  bool
+			err error
+		)
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = matchLogical(doc, key, cond)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, errUnsupportedQuery
+			}
+			value, exists := lookupField(doc, key)
+			ok, err = matchCondition(value, exists, cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc bson.M, op string, cond interface{}) (bool, error) {
+	clauses, ok := cond.([]interface{})
+	if !ok {
+		return false, errUnsupportedQuery
+	}
+
+	matched := 0
+	for _, clause := range clauses {
+		q, ok := asDocument(clause)
+		if !ok {
+			return false, errUnsupportedQuery
+		}
+		ok, err := matchQuery(doc, q)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			matched++
+		}
+	}
+
+	switch op {
+	case "$and":
+		return matched == len(clauses), nil
+	case "$or":
+		return matched > 0, nil
+	default:
+		return matched == 0, nil
+	}
+}
+
+// matchCondition checks one field's value against its condition, which is either a value to
+// compare with, or a document of operators
+func matchCondition(value interface{}, exists bool, cond interface{}) (bool, error) {
+	ops, isDoc := asDocument(cond)
+	if !isDoc || !hasOperators(ops) {
+		return exists && matchValue(value, cond, equal), nil
+	}
+
+	for op, arg := range ops {
+		var ok bool
+		switch op {
+		case "$eq":
+			ok = exists && matchValue(value, arg, equal)
+		case "$ne":
+			ok = !exists || !matchValue(value, arg, equal)
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = exists && matchValue(value, arg, comparison(op))
+		case "$in", "$nin":
+			list, isList := arg.([]interface{})
+			if !isList {
+				return false, errUnsupportedQuery
+			}
+			found := false
+			for _, item := range list {
+				if exists && matchValue(value, item, equal) {
+					found = true
+					break
+				}
+			}
+			ok = found == (op == "$in")
+		case "$exists":
+			want, isBool := arg.(bool)
+			if !isBool {
+				return false, errUnsupportedQuery
+			}
+			ok = exists == want
+		default:
+			return false, errUnsupportedQuery
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchValue compares the value with fn.  like mongo, an array matches when any of its elements do
+func matchValue(value, arg interface{}, fn func(a, b interface{}) bool) bool {
+	if fn(value, arg) {
+		return true
+	}
+	if list, ok := value.([]interface{}); ok {
+		for _, item := range list {
+			if fn(item, arg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func equal(a, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// comparison returns a function comparing values of the same kind.  values of different kinds never compare
+func comparison(op string) func(a, b interface{}) bool {
+	return func(a, b interface{}) bool {
+		c, ok := compare(a, b)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		default:
+			return c <= 0
+		}
+	}
+}
+
+func compare(a, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		return strings.Compare(x, y), ok
+	case bson.ObjectId:
+		y, ok := b.(bson.ObjectId)
+		return strings.Compare(string(x), string(y)), ok
+	case time.Time:
+		y, ok := b.(time.Time)
+		switch {
+		case !ok:
+			return 0, false
+		case x.Before(y):
+			return -1, true
+		case x.After(y):
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func asDocument(v interface{}) (bson.M, bool) {
+	switch d := v.(type) {
+	case bson.M:
+		return d, true
+	case map[string]interface{}:
+		return bson.M(d), true
+	}
+	return nil, false
+}
+
+func hasOperators(doc bson.M) bool {
+	for k := range doc {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
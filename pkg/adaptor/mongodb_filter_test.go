@@ -0,0 +1,182 @@
+package adaptor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMatchQuery(t *testing.T) {
+	doc := bson.M{
+		"_id":     1,
+		"tenant":  "acme",
+		"count":   int64(10),
+		"tags":    []interface{}{"a", "b"},
+		"address": bson.M{"city": "ny"},
+	}
+
+	data := []struct {
+		query bson.M
+		match bool
+		err   error
+	}{
+		{bson.M{}, true, nil},
+		{bson.M{"tenant": "acme"}, true, nil},
+		{bson.M{"tenant": "other"}, false, nil},
+		{bson.M{"count": 10}, true, nil},
+		{bson.M{"count": bson.M{"$gt": 5, "$lte": 10.0}}, true, nil},
+		{bson.M{"count": bson.M{"$lt": 5}}, false, nil},
+		{bson.M{"count": bson.M{"$gt": "5"}}, false, nil},
+		{bson.M{"tags": "b"}, true, nil},
+		{bson.M{"tags": bson.M{"$in": []interface{}{"c", "a"}}}, true, nil},
+		{bson.M{"tags": bson.M{"$nin": []interface{}{"a"}}}, false, nil},
+		{bson.M{"address.city": "ny"}, true, nil},
+		{bson.M{"address.zip": bson.M{"$exists": false}}, true, nil},
+		{bson.M{"tenant": bson.M{"$ne": "acme"}}, false, nil},
+		{bson.M{"$or": []interface{}{bson.M{"tenant": "other"}, bson.M{"count": 10}}}, true, nil},
+		{bson.M{"$and": []interface{}{bson.M{"tenant": "acme"}, bson.M{"count": 11}}}, false, nil},
+		{bson.M{"$nor": []interface{}{bson.M{"tenant": "other"}}}, true, nil},
+		{bson.M{"tenant": bson.M{"$regex": "^ac"}}, false, errUnsupportedQuery},
+		{bson.M{"$where": "this.count > 1"}, false, errUnsupportedQuery},
+	}
+
+	for _, v := range data {
+		match, err := matchQuery(doc, v.query)
+		if err != v.err {
+			t.Errorf("%v: expected error %v, got %v", v.query, v.err, err)
+		}
+		if match != v.match {
+			t.Errorf("%v: expected match %v, got %v", v.query, v.match, match)
+		}
+	}
+}
+
+func TestCheckQuery(t *testing.T) {
+	data := []struct {
+		query bson.M
+		err   string
+	}{
+		{nil, ""},
+		{bson.M{"tenant": "acme", "address.city": bson.M{"$in": []interface{}{"ny"}}}, ""},
+		{bson.M{"$or": []interface{}{bson.M{"count": bson.M{"$gt": 5}}, bson.M{"tags": bson.M{"$exists": true}}}}, ""},
+		{bson.M{"tenant": bson.M{"$regex": "^ac"}}, "$regex isn't supported"},
+		{bson.M{"$where": "this.count > 1"}, "$where isn't supported"},
+		{bson.M{"$and": []interface{}{bson.M{"tags": bson.M{"$size": 2}}}}, "$size isn't supported"},
+		{bson.M{"tags": bson.M{"$in": "a"}}, "$in needs a list"},
+		{bson.M{"$or": bson.M{"tenant": "acme"}}, "$or needs a list of queries"},
+	}
+
+	for _, v := range data {
+		err := checkQuery(v.query)
+		if (err == nil && v.err != "") || (err != nil && err.Error() != v.err) {
+			t.Errorf("%v: expected error %q, got %v", v.query, v.err, err)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	data := []struct {
+		in  interface{}
+		out bson.M
+		err string
+	}{
+		{nil, nil, ""},
+		{"", nil, ""},
+		{`{"tenant": "acme"}`, bson.M{"tenant": "acme"}, ""},
+		{map[string]interface{}{"tenant": "acme"}, bson.M{"tenant": "acme"}, ""},
+		{`{"tenant": `, nil, "malformed query (unexpected end of JSON input)"},
+		{12, nil, "malformed query, expected a document (got int)"},
+	}
+
+	for _, v := range data {
+		out, err := parseQuery(v.in)
+		if err != nil && err.Error() != v.err {
+			t.Errorf("%v: expected error: %v\ngot error: %v\n", v.in, v.err, err)
+		}
+		if !reflect.DeepEqual(out, v.out) {
+			t.Errorf("%v: expected:\n%+v\ngot:\n%+v\n", v.in, v.out, out)
+		}
+	}
+}
+
+func TestFilterOplogMsg(t *testing.T) {
+	m := &Mongodb{
+		query:  bson.M{"tenant": "acme"},
+		fields: []string{"tenant", "address.city"},
+	}
+
+	modified := func(doc bson.M, mod *message.Modifier) *message.Msg {
+		msg := message.NewMsg(message.Update, doc)
+		msg.Modifier = mod
+		return msg
+	}
+
+	data := []struct {
+		in   *message.Msg
+		send bool
+		op   message.OpType
+		doc  bson.M
+		mod  *message.Modifier
+	}{
+		{
+			message.NewMsg(message.Insert, bson.M{"_id": 1, "tenant": "acme", "secret": "x", "address": bson.M{"city": "ny", "zip": "1"}}),
+			true, message.Insert, bson.M{"_id": 1, "tenant": "acme", "address": bson.M{"city": "ny"}}, nil,
+		},
+		{
+			message.NewMsg(message.Insert, bson.M{"_id": 1, "tenant": "other"}),
+			false, message.Insert, nil, nil,
+		},
+		{
+			message.NewMsg(message.Update, bson.M{"_id": 1, "tenant": "other"}),
+			true, message.Delete, bson.M{"_id": 1}, nil,
+		},
+		{
+			message.NewMsg(message.Delete, bson.M{"_id": 1}),
+			true, message.Delete, bson.M{"_id": 1}, nil,
+		},
+		{
+			modified(bson.M{"_id": 1, "tenant": "acme", "secret": "y", "address": bson.M{"city": "ny"}},
+				&message.Modifier{Set: bson.M{"tenant": "acme", "secret": "y"}, Unset: []string{"address.zip"}}),
+			true, message.Update, bson.M{"_id": 1, "tenant": "acme", "address": bson.M{"city": "ny"}}, &message.Modifier{Set: bson.M{"tenant": "acme"}},
+		},
+		{
+			modified(bson.M{"_id": 1, "tenant": "acme", "secret": "y"}, &message.Modifier{Set: bson.M{"secret": "y"}}),
+			false, message.Update, nil, nil,
+		},
+		{
+			modified(bson.M{"_id": 1, "tenant": "acme", "address": bson.M{"city": "sf", "zip": "2"}},
+				&message.Modifier{Set: bson.M{"tenant": "acme", "address": bson.M{"_id": 7, "city": "sf", "zip": "2"}}}),
+			true, message.Update, bson.M{"_id": 1, "tenant": "acme", "address": bson.M{"city": "sf"}},
+			&message.Modifier{Set: bson.M{"tenant": "acme", "address": bson.M{"city": "sf"}}},
+		},
+		{
+			modified(bson.M{"_id": 1, "tenant": "acme", "address": "unknown"}, &message.Modifier{Set: bson.M{"tenant": "acme", "address": "unknown"}}),
+			true, message.Update, bson.M{"_id": 1, "tenant": "acme"}, &message.Modifier{Set: bson.M{"tenant": "acme"}, Unset: []string{"address"}},
+		},
+		{
+			modified(bson.M{"_id": 1, "tenant": "other"}, &message.Modifier{Set: bson.M{"tenant": "other"}}),
+			true, message.Delete, bson.M{"_id": 1}, nil,
+		},
+	}
+
+	for i, v := range data {
+		send := m.filterOplogMsg(v.in)
+		if send != v.send {
+			t.Errorf("%d: expected send to be %v", i, v.send)
+		}
+		if !send {
+			continue
+		}
+		if v.in.Op != v.op {
+			t.Errorf("%d: expected op %s, got %s", i, v.op, v.in.Op)
+		}
+		if !reflect.DeepEqual(v.in.Document(), v.doc) {
+			t.Errorf("%d: expected doc:\n%+v\ngot:\n%+v\n", i, v.doc, v.in.Document())
+		}
+		if !reflect.DeepEqual(v.in.Modifier, v.mod) {
+			t.Errorf("%d: expected modifier:\n%+v\ngot:\n%+v\n", i, v.mod, v.in.Modifier)
+		}
+	}
+}
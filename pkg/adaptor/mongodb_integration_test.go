@@ -0,0 +1,125 @@
+// +build integration
+
+package adaptor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	mongoURI = "mongodb://localhost/test"
+)
+
+func TestMongodbWriteMessage(t *testing.T) {
+	p := pipe.NewPipe(nil, "sink")
+	go func() {
+		for err := range p.Err {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+
+	a, err := NewMongodb(p, "sink", Config{"uri": mongoURI, "namespace": "test.sinkColl", "modifiers": true})
+	if err != nil {
+		t.Fatalf("can't create adaptor: %s", err)
+	}
+	m := a.(*Mongodb)
+	collection := m.mongoSession.DB("test").C("sinkColl")
+	collection.DropCollection()
+
+	update := message.NewMsg(message.Update, bson.M{"_id": 2})
+	update.Modifier = &message.Modifier{Set: bson.M{"name": "bob"}, Unset: []string{"age"}}
+	update.ModifierOnly = true
+
+	msgs := []*message.Msg{
+		message.NewMsg(message.Insert, bson.M{"_id": 1, "name": "nick"}),
+		message.NewMsg(message.Insert, bson.M{"_id": 2, "name": "alice", "age": 30}),
+		message.NewMsg(message.Insert, bson.M{"_id": 3, "name": "carol"}),
+		message.NewMsg(message.Insert, bson.M{"_id": 1, "name": "nicky"}), // a duplicate replaces
+		update,
+		message.NewMsg(message.Update, bson.M{"_id": 4, "name": "dave"}), // upserted
+		message.NewMsg(message.Delete, bson.M{"_id": 3}),
+		message.NewMsg(message.Delete, bson.M{"_id": 5}), // already gone
+		message.NewMsg(message.Command, bson.M{"flush": true}),
+	}
+	for _, msg := range msgs {
+		m.writeMessage(msg)
+	}
+
+	var results []bson.M
+	if err := collection.Find(nil).Sort("_id").All(&results); err != nil {
+		t.Fatalf("can't read collection: %s", err)
+	}
+
+	expected := []bson.M{
+		{"_id": 1, "name": "nicky"},
+		{"_id": 2, "name": "bob"},
+		{"_id": 4, "name": "dave"},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected:\n%+v\ngot:\n%+v\n", expected, results)
+	}
+}
+
+func TestMongodbBulkWrite(t *testing.T) {
+	p := pipe.NewPipe(nil, "sink")
+	errs := make(chan error, 10)
+	go func() {
+		for err := range p.Err {
+			errs <- err
+		}
+	}()
+
+	a, err := NewMongodb(p, "sink", Config{"uri": mongoURI, "namespace": "test.bulkColl", "bulk_size": 4, "modifiers": true})
+	if err != nil {
+		t.Fatalf("can't create adaptor: %s", err)
+	}
+	m := a.(*Mongodb)
+	collection := m.mongoSession.DB("test").C("bulkColl")
+	collection.DropCollection()
+
+	bad := message.NewMsg(message.Update, bson.M{"_id": 2})
+	bad.Modifier = &message.Modifier{Set: bson.M{"_id": 99}} // _id can't be changed
+	bad.ModifierOnly = true
+
+	msgs := []*message.Msg{
+		message.NewMsg(message.Insert, bson.M{"_id": 1, "name": "nick"}),
+		message.NewMsg(message.Insert, bson.M{"_id": 2, "name": "alice"}),
+		bad,
+		message.NewMsg(message.Insert, bson.M{"_id": 1, "name": "nicky"}), // the batch is full here
+		message.NewMsg(message.Delete, bson.M{"_id": 2}),
+		message.NewMsg(message.Insert, bson.M{"_id": 3, "name": "carol"}),
+		message.NewMsg(message.Command, bson.M{"flush": true}),
+	}
+	for _, msg := range msgs {
+		m.writeMessage(msg)
+	}
+
+	var results []bson.M
+	if err := collection.Find(nil).Sort("_id").All(&results); err != nil {
+		t.Fatalf("can't read collection: %s", err)
+	}
+
+	expected := []bson.M{
+		{"_id": 1, "name": "nicky"},
+		{"_id": 3, "name": "carol"},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected:\n%+v\ngot:\n%+v\n", expected, results)
+	}
+
+	select {
+	case err := <-errs:
+		aerr, ok := err.(Error)
+		if !ok || !reflect.DeepEqual(aerr.Record, bson.M{"_id": 2}) {
+			t.Errorf("expected an adaptor.Error for the failed update, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected an error for the failed update")
+	}
+}
@@ -0,0 +1,136 @@
+package adaptor
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// the retry policy used when the config doesn't set one
+const (
+	defaultMaxRetries   = 5
+	defaultRetryBackoff = 1 * time.Second
+
+	// the longest we wait between two attempts, however many retries there have been
+	maxRetryBackoff = 1 * time.Minute
+)
+
+// server error codes that mean the operation might work if it's tried again, i.e. a primary stepping down,
+// or a shutdown in progress
+var transientCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	9001:  true, // SocketException
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// retryPolicy decides whether a failed mongo operation is tried again, and how long to wait first.
+// only transient errors are retried, and the wait doubles after every retry
+type retryPolicy struct {
+	maxRetries int
+	backoff    time.Duration // the wait before the first retry
+}
+
+// newRetryPolicy builds the policy from the max_retries and retry_backoff options.  max_retries of 0
+// uses the default, and a negative max_retries turns retries off
+func newRetryPolicy(maxRetries int, backoff string) (retryPolicy, error) {
+	r := retryPolicy{maxRetries: maxRetries, backoff: defaultRetryBackoff}
+	switch {
+	case maxRetries == 0:
+		r.maxRetries = defaultMaxRetries
+	case maxRetries < 0:
+		r.maxRetries = 0
+	}
+
+	if backoff != "" {
+		var err error
+		if r.backoff, err = time.ParseDuration(backoff); err != nil {
+			return r, fmt.Errorf("malformed retry_backoff (%s)", err.Error())
+		}
+	}
+	return r, nil
+}
+
+// wait returns how long to wait before the given retry, counting from 1
+func (r retryPolicy) wait(retry int) time.Duration {
+	d := r.backoff
+	for i := 1; i < retry && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return d
+}
+
+// retry returns false if the error isn't transient, or if we've already made the last retry.
+// otherwise it waits out the backoff for the given retry, and returns true
+func (r retryPolicy) retry(err error, retry int) bool {
+	if retry > r.maxRetries || !isTransient(err) {
+		return false
+	}
+	time.Sleep(r.wait(retry))
+	return true
+}
+
+// do calls fn until it succeeds, returns an error that isn't transient, or we run out of retries.
+// the session is refreshed before each retry, so that it lets go of a broken connection
+func (r retryPolicy) do(session *mgo.Session, fn func() error) error {
+	for retry := 1; ; retry++ {
+		err := fn()
+		if err == nil || !r.retry(err, retry) {
+			return err
+		}
+		refreshSession(session)
+	}
+}
+
+// refreshSession drops the session's connections, so the next operation dials again
+func refreshSession(session *mgo.Session) {
+	if session != nil {
+		session.Refresh()
+	}
+}
+
+// isTransient is true for errors that come from the network, or from the cluster changing its primary,
+// rather than from the operation itself
+func isTransient(err error) bool {
+	if err == nil || err == mgo.ErrNotFound || mgo.IsDup(err) {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	switch e := err.(type) {
+	case net.Error:
+		return true
+	case *mgo.LastError:
+		return transientCodes[e.Code]
+	case *mgo.QueryError:
+		return transientCodes[e.Code]
+	case *mgo.BulkError:
+		cases := e.Cases()
+		return len(cases) > 0 && isTransient(cases[0].Err)
+	}
+
+	// mgo doesn't give these their own types
+	msg := err.Error()
+	for _, s := range []string{"no reachable servers", "Closed explicitly", "connection reset", "broken pipe", "i/o timeout"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
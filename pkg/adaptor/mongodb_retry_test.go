@@ -0,0 +1,98 @@
+package adaptor
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	data := []struct {
+		maxRetries int
+		backoff    string
+		expected   retryPolicy
+		err        bool
+	}{
+		{0, "", retryPolicy{defaultMaxRetries, defaultRetryBackoff}, false},
+		{3, "250ms", retryPolicy{3, 250 * time.Millisecond}, false},
+		{-1, "", retryPolicy{0, defaultRetryBackoff}, false},
+		{3, "soon", retryPolicy{}, true},
+	}
+
+	for _, v := range data {
+		r, err := newRetryPolicy(v.maxRetries, v.backoff)
+		if (err != nil) != v.err {
+			t.Errorf("%d %q: expected error to be %v, got %v", v.maxRetries, v.backoff, v.err, err)
+			continue
+		}
+		if err == nil && r != v.expected {
+			t.Errorf("%d %q: expected %+v, got %+v", v.maxRetries, v.backoff, v.expected, r)
+		}
+	}
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	r := retryPolicy{maxRetries: 10, backoff: 10 * time.Second}
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, e := range expected {
+		if got := r.wait(i + 1); got != e {
+			t.Errorf("retry %d: expected to wait %s, got %s", i+1, e, got)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	r := retryPolicy{maxRetries: 3, backoff: time.Millisecond}
+
+	data := []struct {
+		name     string
+		errs     []error
+		calls    int
+		expected error
+	}{
+		{"succeeds", nil, 1, nil},
+		{"recovers", []error{io.EOF, io.EOF}, 3, nil},
+		{"gives up", []error{io.EOF, io.EOF, io.EOF, io.EOF, io.EOF}, 4, io.EOF},
+		{"not transient", []error{mgo.ErrNotFound}, 1, mgo.ErrNotFound},
+	}
+
+	for _, v := range data {
+		calls := 0
+		err := r.do(nil, func() error {
+			calls++
+			if calls <= len(v.errs) {
+				return v.errs[calls-1]
+			}
+			return nil
+		})
+		if err != v.expected || calls != v.calls {
+			t.Errorf("%s: expected %v after %d calls, got %v after %d", v.name, v.expected, v.calls, err, calls)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	data := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{errors.New("no reachable servers"), true},
+		{errors.New("read tcp 127.0.0.1:27017: connection reset by peer"), true},
+		{&mgo.LastError{Code: 10107, Err: "not master"}, true},
+		{&mgo.QueryError{Code: 11600, Message: "interrupted at shutdown"}, true},
+		{&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}, false},
+		{&mgo.QueryError{Code: 2, Message: "unknown operator: $boom"}, false},
+		{mgo.ErrNotFound, false},
+	}
+
+	for _, v := range data {
+		if got := isTransient(v.err); got != v.transient {
+			t.Errorf("%v: expected transient to be %v, got %v", v.err, v.transient, got)
+		}
+	}
+}
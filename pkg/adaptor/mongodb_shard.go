@@ -0,0 +1,288 @@
+package adaptor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// an oplogShard is one shard of a sharded cluster.  every shard is a replica set with its own oplog,
+// and we keep track of how far through each oplog we've gotten separately
+type oplogShard struct {
+	name      string
+	session   *mgo.Session
+	oplogTime bson.MongoTimestamp // the last entry from this shard that was sent
+
+	// tailOplog opens a tailing cursor on the shard's oplog, for the entries after the given timestamp
+	tailOplog func(bson.MongoTimestamp) oplogIterator
+}
+
+// checkpointPath is where the shard's oplog position is saved, under the node's path
+func (s *oplogShard) checkpointPath(path string) string {
+	return path + "/" + s.name
+}
+
+// a shardEntry is what a shard's reader hands to tailShards.  entry is nil when the reader has caught up
+// with the shard's oplog, and err is set when the reader has given up
+type shardEntry struct {
+	shard *oplogShard
+	entry *oplogDoc
+	err   error
+}
+
+// findShards asks the server if it's a mongos, and if it is, connects to each of the shards listed in config.shards.
+// returns nil when we're connected to a replica set.  the shards are dialed with the same options and credentials as the mongos
+func (m *Mongodb) findShards() ([]*oplogShard, error) {
+	var isMaster struct {
+		Msg string `bson:"msg"`
+	}
+	if err := m.mongoSession.Run("isMaster", &isMaster); err != nil {
+		return nil, NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't run isMaster %s)", err.Error()), nil)
+	}
+	if isMaster.Msg != "isdbgrid" {
+		return nil, nil
+	}
+
+	var docs []struct {
+		ID   string `bson:"_id"`
+		Host string `bson:"host"`
+	}
+	if err := m.mongoSession.DB("config").C("shards").Find(nil).Sort("_id").All(&docs); err != nil {
+		return nil, NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't list shards %s)", err.Error()), nil)
+	}
+	if len(docs) == 0 {
+		return nil, NewError(CRITICAL, m.path, "Mongodb error (the cluster has no shards)", nil)
+	}
+
+	shards := make([]*oplogShard, 0, len(docs))
+	for _, doc := range docs {
+		info := *m.dialInfo
+		info.ReplicaSetName, info.Addrs = parseShardHost(doc.Host)
+		info.Direct = false
+
+		session, err := mgo.DialWithInfo(&info)
+		if err != nil {
+			for _, shard := range shards {
+				shard.session.Close()
+			}
+			return nil, NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't connect to shard %s %s)", doc.ID, err.Error()), nil)
+		}
+
+		m.configureSession(session)
+
+		shard := &oplogShard{name: doc.ID, session: session}
+		shard.tailOplog = func(ts bson.MongoTimestamp) oplogIterator {
+			return m.oplogCursor(shard.session, ts)
+		}
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
+
+// closeShards closes the connections to the shards
+func (m *Mongodb) closeShards() {
+	for _, shard := range m.shards {
+		if shard.session != nil {
+			shard.session.Close()
+		}
+	}
+}
+
+// parseShardHost splits the host field of a config.shards document, i.e. rs0/a:27017,b:27017, into
+// the replica set name and its members.  shards that aren't replica sets have no name
+func parseShardHost(host string) (string, []string) {
+	var name string
+	if i := strings.Index(host, "/"); i >= 0 {
+		name, host = host[:i], host[i+1:]
+	}
+	return name, strings.Split(host, ",")
+}
+
+/*
+ * tail the oplog of every shard, starting with the first entry after each shard's oplogTime.
+ * each shard is read concurrently, and the entries are merged in timestamp order.  an entry is only sent once every
+ * other shard has either an entry waiting or has caught up with its oplog, so a shard that's running behind can't
+ * have its entries sent after newer entries from the others.
+ */
+func (m *Mongodb) tailShards() error {
+	var (
+		entries = make(chan shardEntry)
+		done    = make(chan struct{})
+		pending = make(map[*oplogShard][]oplogDoc)
+		idle    = make(map[*oplogShard]bool)
+	)
+	defer close(done)
+
+	for _, shard := range m.shards {
+		go m.readShard(shard, entries, done)
+	}
+
+	// record where we've got to, if the sinks have flushed it by the time we exit
+	m.checkpoint()
+	defer m.saveCheckpoint()
+
+	for {
+		select {
+		case e := <-entries:
+			switch {
+			case e.err != nil:
+				return e.err
+			case e.entry == nil:
+				idle[e.shard] = true
+			default:
+				pending[e.shard] = append(pending[e.shard], *e.entry)
+				idle[e.shard] = false
+			}
+		case <-m.stop:
+			return nil
+		}
+
+		for {
+			select {
+			case <-m.stop:
+				return nil
+			default:
+			}
+
+			shard := nextShard(m.shards, pending, idle)
+			if shard == nil {
+				break
+			}
+			entry := pending[shard][0]
+			pending[shard] = pending[shard][1:]
+
+			shard.oplogTime = entry.Ts
+			if msg := m.oplogMsg(entry); msg != nil && m.filterOplogMsg(msg) {
+				m.pipe.Send(msg)
+			}
+			m.checkpoint()
+		}
+		m.checkpoint()
+	}
+}
+
+// nextShard returns the shard holding the oldest waiting entry, or nil if there isn't one, or if some
+// shard has nothing waiting but hasn't caught up with its oplog yet
+func nextShard(shards []*oplogShard, pending map[*oplogShard][]oplogDoc, idle map[*oplogShard]bool) *oplogShard {
+	var next *oplogShard
+	for _, shard := range shards {
+		if len(pending[shard]) == 0 {
+			if !idle[shard] {
+				return nil
+			}
+			continue
+		}
+		if next == nil || pending[shard][0].Ts < pending[next][0].Ts {
+			next = shard
+		}
+	}
+	return next
+}
+
+// shardCaughtUpWait is how long a shard's reader waits on its cursor before it reports that it has caught up.
+// entries the cursor has buffered come back well within it, so it only runs out when the cursor is waiting on the shard
+const shardCaughtUpWait = 10 * time.Millisecond
+
+// readShard reads the shard's oplog onto entries until done is closed.  whenever the cursor has nothing buffered,
+// and is waiting on the shard for new entries, the reader reports that it has caught up, so that the other shards
+// don't wait on it
+func (m *Mongodb) readShard(shard *oplogShard, entries chan<- shardEntry, done <-chan struct{}) {
+	var (
+		reads    = make(chan shardEntry)
+		caughtUp bool
+	)
+	go m.tailShard(shard, reads, done)
+
+	send := func(e shardEntry) bool {
+		select {
+		case entries <- e:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	for {
+		var wait <-chan time.Time // nil once we've reported that we've caught up, until the next entry
+		if !caughtUp {
+			wait = time.After(shardCaughtUpWait)
+		}
+
+		select {
+		case e := <-reads:
+			if !send(e) || e.err != nil {
+				return
+			}
+			caughtUp = e.entry == nil
+		case <-wait:
+			if !send(shardEntry{shard: shard}) {
+				return
+			}
+			caughtUp = true
+		case <-done:
+			return
+		}
+	}
+}
+
+// tailShard tails the shard's oplog onto reads until done is closed.  every time the cursor times out, it
+// reports that it has caught up.  when the cursor dies, it's reissued from the last entry read
+func (m *Mongodb) tailShard(shard *oplogShard, reads chan<- shardEntry, done <-chan struct{}) {
+	var (
+		result oplogDoc
+		ts     = shard.oplogTime
+		iter   = shard.tailOplog(ts)
+		retry  = 0
+	)
+	defer func() {
+		iter.Close()
+	}()
+
+	send := func(e shardEntry) bool {
+		select {
+		case reads <- e:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	for {
+		for iter.Next(&result) {
+			ts = result.Ts
+			entry := result
+			if !send(shardEntry{shard: shard, entry: &entry}) {
+				return
+			}
+			result = oplogDoc{}
+			retry = 0
+		}
+
+		switch {
+		case iter.Timeout():
+			if !send(shardEntry{shard: shard}) {
+				return
+			}
+		case iter.Err() != nil && !m.retries.retry(iter.Err(), retry+1):
+			err := NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (error reading shard %s %s)", shard.name, iter.Err()), nil)
+			send(shardEntry{shard: shard, err: err})
+			return
+		default:
+			// the cursor is dead, or failed and we're retrying it, reissue the query from the last entry we read
+			if iter.Err() != nil {
+				retry++
+				refreshSession(shard.session)
+			}
+			iter.Close()
+			select {
+			case <-done:
+				return
+			default:
+			}
+			iter = shard.tailOplog(ts)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package adaptor
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// shardIter yields its entries, and then times out forever, like a tailing cursor on a quiet oplog.  with wait
+// set, it blocks on wait instead, like a cursor with a long timeout
+type shardIter struct {
+	entries []oplogDoc
+	timeout bool
+	wait    chan struct{}
+}
+
+func (i *shardIter) Next(result interface{}) bool {
+	if len(i.entries) == 0 {
+		if i.wait != nil {
+			<-i.wait
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+		i.timeout = true
+		return false
+	}
+	*result.(*oplogDoc) = i.entries[0]
+	i.entries = i.entries[1:]
+	return true
+}
+
+func (i *shardIter) Timeout() bool { return i.timeout }
+func (i *shardIter) Err() error    { return nil }
+func (i *shardIter) Close() error  { return nil }
+
+func fakeShard(name string, entries ...oplogDoc) *oplogShard {
+	return &oplogShard{
+		name: name,
+		tailOplog: func(ts bson.MongoTimestamp) oplogIterator {
+			var remaining []oplogDoc
+			for _, e := range entries {
+				if e.Ts > ts {
+					remaining = append(remaining, e)
+				}
+			}
+			return &shardIter{entries: remaining}
+		},
+	}
+}
+
+func TestTailShardsMergesInOrder(t *testing.T) {
+	source := pipe.NewPipe(nil, "source")
+	sink := pipe.NewPipe(source, "source/sink")
+
+	shard0 := fakeShard("shard0",
+		oplogDoc{Ts: newMongoTimestamp(99, 1), Op: "i", Ns: "test.colln", O: bson.M{"_id": "before"}}, // already in the copy
+		oplogDoc{Ts: newMongoTimestamp(101, 1), Op: "i", Ns: "test.colln", O: bson.M{"_id": 1}},
+		oplogDoc{Ts: newMongoTimestamp(103, 1), Op: "i", Ns: "test.colln", O: bson.M{"_id": 3}},
+		oplogDoc{Ts: newMongoTimestamp(104, 1), Op: "d", Ns: "test.colln", O: bson.M{"_id": 3}, FromMigrate: true}, // the balancer moved it
+		oplogDoc{Ts: newMongoTimestamp(106, 1), Op: "d", Ns: "test.colln", O: bson.M{"_id": 1}},
+	)
+	shard0.oplogTime = newMongoTimestamp(100, 1)
+	shard1 := fakeShard("shard1",
+		oplogDoc{Ts: newMongoTimestamp(102, 1), Op: "i", Ns: "test.colln", O: bson.M{"_id": 2}},
+		oplogDoc{Ts: newMongoTimestamp(104, 2), Op: "i", Ns: "test.colln", O: bson.M{"_id": 3}, FromMigrate: true}, // the balancer moved it
+		oplogDoc{Ts: newMongoTimestamp(105, 1), Op: "i", Ns: "test.colln", O: bson.M{"_id": 4}},
+		oplogDoc{Ts: newMongoTimestamp(107, 1), Op: "i", Ns: "test.colln", O: bson.M{"_id": 5}},
+	)
+
+	m := &Mongodb{
+		pipe:         source,
+		path:         "source",
+		database:     "test",
+		collection:   "colln",
+		oplogTimeout: 10 * time.Millisecond,
+		shards:       []*oplogShard{shard0, shard1},
+		stop:         make(chan struct{}),
+	}
+
+	type op struct {
+		Op message.OpType
+		ID interface{}
+	}
+	expected := []op{
+		{message.Insert, 1},
+		{message.Insert, 2},
+		{message.Insert, 3},
+		{message.Insert, 4},
+		{message.Delete, 1},
+		{message.Insert, 5},
+	}
+
+	received := make(chan []op)
+	go func() {
+		var ops []op
+		for msg := range sink.In {
+			ops = append(ops, op{msg.Op, msg.ID})
+			if len(ops) == len(expected) {
+				close(m.stop) // what Stop does, without stopping the pipe we're reading from
+			}
+		}
+		received <- ops
+	}()
+
+	if err := m.tailShards(); err != nil {
+		t.Fatalf("tailShards returned an error: %s", err)
+	}
+	close(sink.In)
+
+	if got := <-received; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected:\n%+v\ngot:\n%+v\n", expected, got)
+	}
+
+	if shard0.oplogTime != newMongoTimestamp(106, 1) || shard1.oplogTime != newMongoTimestamp(107, 1) {
+		t.Errorf("expected each shard's oplogTime to be the last entry sent from it, got %d and %d", shard0.oplogTime, shard1.oplogTime)
+	}
+}
+
+func TestTailShardsDoesntWaitOnQuietShards(t *testing.T) {
+	source := pipe.NewPipe(nil, "source")
+	sink := pipe.NewPipe(source, "source/sink")
+
+	release := make(chan struct{})
+	defer close(release)
+
+	// neither cursor times out, so the shards have to be caught up as soon as they've nothing buffered
+	var shards []*oplogShard
+	for i, entries := range [][]oplogDoc{
+		{{Ts: newMongoTimestamp(101, 1), Op: "i", Ns: "test.colln", O: bson.M{"_id": 1}}, {Ts: newMongoTimestamp(103, 1), Op: "i", Ns: "test.colln", O: bson.M{"_id": 3}}},
+		{{Ts: newMongoTimestamp(102, 1), Op: "i", Ns: "test.colln", O: bson.M{"_id": 2}}},
+	} {
+		shard := fakeShard(fmt.Sprintf("shard%d", i), entries...)
+		tail := shard.tailOplog
+		shard.tailOplog = func(ts bson.MongoTimestamp) oplogIterator {
+			iter := tail(ts).(*shardIter)
+			iter.wait = release
+			return iter
+		}
+		shards = append(shards, shard)
+	}
+
+	m := &Mongodb{
+		pipe:         source,
+		path:         "source",
+		database:     "test",
+		collection:   "colln",
+		oplogTimeout: time.Hour,
+		shards:       shards,
+		stop:         make(chan struct{}),
+	}
+	go m.tailShards()
+	defer close(m.stop)
+
+	for _, id := range []int{1, 2, 3} {
+		select {
+		case msg := <-sink.In:
+			if msg.ID != id {
+				t.Fatalf("expected %d, got %v", id, msg.ID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d to be sent without waiting for the cursors to time out", id)
+		}
+	}
+}
+
+func TestParseShardHost(t *testing.T) {
+	data := []struct {
+		in    string
+		name  string
+		addrs []string
+	}{
+		{"rs0/a:27017,b:27017", "rs0", []string{"a:27017", "b:27017"}},
+		{"a:27017", "", []string{"a:27017"}},
+	}
+
+	for _, v := range data {
+		name, addrs := parseShardHost(v.in)
+		if name != v.name || !reflect.DeepEqual(addrs, v.addrs) {
+			t.Errorf("%s: expected %s %v, got %s %v", v.in, v.name, v.addrs, name, addrs)
+		}
+	}
+}
+
+func TestCopyVersion(t *testing.T) {
+	m := &Mongodb{oplogTime: newMongoTimestamp(100, 1)}
+	if v := m.copyVersion(); v != int64(newMongoTimestamp(100, 1)) {
+		t.Errorf("expected the oplog snapshot, got %d", v)
+	}
+
+	// copied documents are only as new as the oldest shard's snapshot
+	shard0, shard1 := fakeShard("rs0"), fakeShard("rs1")
+	shard0.oplogTime, shard1.oplogTime = newMongoTimestamp(105, 1), newMongoTimestamp(103, 2)
+	m.shards = []*oplogShard{shard0, shard1}
+	if v := m.copyVersion(); v != int64(newMongoTimestamp(103, 2)) {
+		t.Errorf("expected the oldest shard's snapshot, got %d", v)
+	}
+}
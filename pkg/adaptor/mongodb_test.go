@@ -0,0 +1,404 @@
+package adaptor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeOplog stands in for the mongo oplog.  every cursor it hands out yields at most perCursor
+// entries before dying, and times out after every timeoutEvery entries, so tailData has to
+// both wait on and reissue its cursors
+type fakeOplog struct {
+	entries      []oplogDoc
+	perCursor    int
+	timeoutEvery int
+	opened       []bson.MongoTimestamp
+	pipe         *pipe.Pipe
+}
+
+func (f *fakeOplog) tail(ts bson.MongoTimestamp) oplogIterator {
+	f.opened = append(f.opened, ts)
+
+	var remaining []oplogDoc
+	for _, e := range f.entries {
+		if e.Ts > ts {
+			remaining = append(remaining, e)
+		}
+	}
+	if len(remaining) == 0 { // we've replayed everything, time to quit
+		f.pipe.Stop()
+	}
+	if len(remaining) > f.perCursor {
+		remaining = remaining[:f.perCursor]
+	}
+	return &fakeIter{entries: remaining, timeoutEvery: f.timeoutEvery}
+}
+
+type fakeIter struct {
+	entries      []oplogDoc
+	timeoutEvery int
+	sent         int
+	timeout      bool
+}
+
+func (i *fakeIter) Next(result interface{}) bool {
+	if !i.timeout && i.sent > 0 && i.sent%i.timeoutEvery == 0 && len(i.entries) > 0 {
+		i.timeout = true
+		return false
+	}
+	i.timeout = false
+	if len(i.entries) == 0 {
+		return false
+	}
+	*result.(*oplogDoc) = i.entries[0]
+	i.entries = i.entries[1:]
+	i.sent++
+	return true
+}
+
+func (i *fakeIter) Timeout() bool { return i.timeout }
+func (i *fakeIter) Err() error    { return nil }
+func (i *fakeIter) Close() error  { return nil }
+
+func TestTailDataReplaysInOrder(t *testing.T) {
+	source := pipe.NewPipe(nil, "source")
+	sink := pipe.NewPipe(source, "source/sink")
+
+	snapshot := newMongoTimestamp(100, 1)
+	oplog := &fakeOplog{
+		entries: []oplogDoc{
+			{Ts: newMongoTimestamp(99, 1), Op: "i", Ns: "test.colln", O: bson.M{"_id": "before"}}, // already in the copy
+			{Ts: snapshot, Op: "i", Ns: "test.colln", O: bson.M{"_id": "snapshot"}},               // already in the copy
+			{Ts: newMongoTimestamp(100, 2), Op: "i", Ns: "test.colln", O: bson.M{"_id": 1}},
+			{Ts: newMongoTimestamp(100, 3), Op: "d", Ns: "test.colln", O: bson.M{"_id": 0}},
+			{Ts: newMongoTimestamp(101, 1), Op: "n", Ns: "test.colln", O: bson.M{"msg": "noop"}},
+			{Ts: newMongoTimestamp(101, 2), Op: "i", Ns: "test.colln", O: bson.M{"_id": 2}},
+			{Ts: newMongoTimestamp(101, 3), Op: "i", Ns: "test.other", O: bson.M{"_id": 4}},     // not our collection
+			{Ts: newMongoTimestamp(101, 4), Op: "i", Ns: "test.system.js", O: bson.M{"_id": 5}}, // never replicated
+			{Ts: newMongoTimestamp(102, 1), Op: "d", Ns: "test.colln", O: bson.M{"_id": 1}},
+			{Ts: newMongoTimestamp(102, 2), Op: "i", Ns: "test.colln", O: bson.M{"_id": 3}},
+			{Ts: newMongoTimestamp(103, 1), Op: "d", Ns: "test.colln", O: bson.M{"_id": 2}},
+		},
+		perCursor:    3,
+		timeoutEvery: 2,
+		pipe:         source,
+	}
+
+	m := &Mongodb{
+		pipe:       source,
+		path:       "source",
+		database:   "test",
+		collection: "colln",
+		oplogTime:  snapshot,
+		tailOplog:  oplog.tail,
+	}
+
+	type op struct {
+		Op message.OpType
+		ID interface{}
+	}
+	received := make(chan []op)
+	go func() {
+		var ops []op
+		for msg := range sink.In {
+			ops = append(ops, op{msg.Op, msg.ID})
+		}
+		received <- ops
+	}()
+
+	if err := m.tailData(); err != nil {
+		t.Fatalf("tailData returned an error: %s", err)
+	}
+	close(sink.In)
+
+	expected := []op{
+		{message.Insert, 1},
+		{message.Delete, 0},
+		{message.Insert, 2},
+		{message.Delete, 1},
+		{message.Insert, 3},
+		{message.Delete, 2},
+	}
+	if got := <-received; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected:\n%+v\ngot:\n%+v\n", expected, got)
+	}
+
+	if m.oplogTime != newMongoTimestamp(103, 1) {
+		t.Errorf("expected oplogTime to be the last entry sent, got %d", m.oplogTime)
+	}
+
+	// every reissued cursor should start from the last entry that was sent
+	for i, ts := range oplog.opened[1:] {
+		if ts <= oplog.opened[i] {
+			t.Errorf("cursor %d reopened at %d, which isn't after %d", i+1, ts, oplog.opened[i])
+		}
+	}
+}
+
+// memoryStore is a checkpoint store that keeps its checkpoints in a map
+type memoryStore map[string]int64
+
+func (s memoryStore) Save(path string, checkpoint int64) error {
+	s[path] = checkpoint
+	return nil
+}
+
+func (s memoryStore) Load(path string) (int64, bool, error) {
+	checkpoint, ok := s[path]
+	return checkpoint, ok, nil
+}
+
+func TestCheckpointWaitsForFlush(t *testing.T) {
+	source := pipe.NewPipe(nil, "source")
+	sink := pipe.NewPipe(source, "source/sink")
+	store := memoryStore{}
+
+	m := &Mongodb{
+		pipe:        source,
+		path:        "source",
+		oplogTime:   newMongoTimestamp(100, 1),
+		checkpoints: store,
+	}
+
+	flushes := make(chan *message.Msg, 2)
+	go func() {
+		for msg := range sink.In {
+			flushes <- msg
+		}
+	}()
+
+	m.checkpoint()
+	flush := <-flushes
+	if flush.Op != message.Command || flush.Ack == nil {
+		t.Fatalf("expected a flush with an ack, got %+v", flush)
+	}
+
+	// the sink hasn't flushed yet, so nothing is saved, and we don't ask again
+	m.oplogTime = newMongoTimestamp(101, 1)
+	m.lastCheckpoint = time.Time{}
+	m.checkpoint()
+	if len(store) != 0 {
+		t.Errorf("expected nothing to be saved before the sink flushed, got %v", store)
+	}
+
+	flush.Ack.Done()
+	m.saveCheckpoint()
+	if store["source"] != int64(newMongoTimestamp(100, 1)) {
+		t.Errorf("expected the position before the flush to be saved, got %v", store)
+	}
+	close(sink.In)
+	if len(flushes) != 0 {
+		t.Errorf("expected a single flush, got %d more", len(flushes))
+	}
+}
+
+func TestParseModifier(t *testing.T) {
+	data := []struct {
+		in  bson.M
+		out *message.Modifier
+		err string
+	}{
+		{
+			bson.M{"_id": 1, "name": "nick"},
+			nil,
+			"",
+		},
+		{
+			bson.M{"$set": bson.M{"name": "nick", "address.city": "ny"}},
+			&message.Modifier{Set: bson.M{"name": "nick", "address.city": "ny"}},
+			"",
+		},
+		{
+			bson.M{"$v": 1, "$unset": bson.M{"b": true, "a": true}, "$set": bson.M{"c": 1}},
+			&message.Modifier{Set: bson.M{"c": 1}, Unset: []string{"a", "b"}},
+			"",
+		},
+		{
+			bson.M{"$set": "nick"},
+			nil,
+			"malformed $set (nick)",
+		},
+		{
+			bson.M{"$rename": bson.M{"a": "b"}},
+			nil,
+			"unsupported update operator $rename",
+		},
+	}
+
+	for _, v := range data {
+		mod, err := parseModifier(v.in)
+		if err != nil && err.Error() != v.err {
+			t.Errorf("expected error: %v\ngot error: %v\n", v.err, err)
+		}
+		if err == nil && v.err != "" {
+			t.Errorf("expected error: %v, got none", v.err)
+		}
+		if !reflect.DeepEqual(mod, v.out) {
+			t.Errorf("expected:\n%+v\ngot:\n%+v\n", v.out, mod)
+		}
+	}
+}
+
+func TestUpdateDoc(t *testing.T) {
+	m := &Mongodb{}
+
+	data := []struct {
+		in  oplogDoc
+		doc bson.M
+		mod *message.Modifier
+	}{
+		{
+			oplogDoc{Op: "u", O2: bson.M{"_id": 1}, O: bson.M{"_id": 1, "name": "nick"}},
+			bson.M{"_id": 1, "name": "nick"},
+			nil,
+		},
+		{
+			oplogDoc{Op: "u", O2: bson.M{"_id": 1}, O: bson.M{"$set": bson.M{"name": "nick"}}},
+			bson.M{"_id": 1},
+			&message.Modifier{Set: bson.M{"name": "nick"}},
+		},
+	}
+
+	for _, v := range data {
+		doc, mod, err := m.updateDoc(v.in)
+		if err != nil {
+			t.Errorf("got error: %s", err)
+		}
+		if !reflect.DeepEqual(doc, v.doc) {
+			t.Errorf("expected doc:\n%+v\ngot:\n%+v\n", v.doc, doc)
+		}
+		if !reflect.DeepEqual(mod, v.mod) {
+			t.Errorf("expected modifier:\n%+v\ngot:\n%+v\n", v.mod, mod)
+		}
+	}
+
+	if _, _, err := m.updateDoc(oplogDoc{Op: "u", O: bson.M{"$set": bson.M{"name": "nick"}}}); err == nil {
+		t.Errorf("expected an error for an update without an _id")
+	}
+}
+
+func TestWriteMessageNeedsModifiers(t *testing.T) {
+	p := pipe.NewPipe(nil, "sink")
+	errs := make(chan error, 1)
+	go func() {
+		for err := range p.Err {
+			errs <- err
+		}
+	}()
+
+	m := &Mongodb{pipe: p, path: "sink"}
+	update := message.NewMsg(message.Update, bson.M{"_id": 1})
+	update.Modifier = &message.Modifier{Set: bson.M{"name": "nick"}}
+	update.ModifierOnly = true
+	m.writeMessage(update)
+
+	if err := <-errs; err.(Error).Lvl != ERROR {
+		t.Errorf("expected an error for an update that only carries a modifier, got %s", err)
+	}
+}
+
+func TestMatchNamespace(t *testing.T) {
+	data := []struct {
+		namespace string
+		matches   map[string]bool
+	}{
+		{
+			"app.users",
+			map[string]bool{"app.users": true, "app.users2": false, "other.users": false},
+		},
+		{
+			"app.*",
+			map[string]bool{"app.users": true, "app.orders.2014": true, "app.system.indexes": false, "other.users": false},
+		},
+		{
+			`app./^events_\d+$/`,
+			map[string]bool{"app.events_1": true, "app.events_201410": true, "app.events_x": false, "app.old_events_1": false},
+		},
+	}
+
+	for _, v := range data {
+		m := &Mongodb{}
+		var err error
+		m.database, m.collection, err = m.splitNamespace(v.namespace)
+		if err != nil {
+			t.Fatalf("can't split %s: %s", v.namespace, err)
+		}
+		if m.collectionMatch, err = parseCollectionMatch(m.collection); err != nil {
+			t.Fatalf("can't parse %s: %s", v.namespace, err)
+		}
+
+		for ns, want := range v.matches {
+			if got := m.matchNamespace(ns); got != want {
+				t.Errorf("%s matching %s, expected %v, got %v", v.namespace, ns, want, got)
+			}
+		}
+	}
+
+	if _, err := parseCollectionMatch("/events_(/"); err == nil {
+		t.Errorf("expected an error for a malformed regex")
+	}
+}
+
+func TestBuildRanges(t *testing.T) {
+	a, b := bson.ObjectIdHex("546656989330a846dc7ce327"), bson.ObjectIdHex("546656989330a846dc7ce328")
+
+	// a collection with _ids of more than one type has a range for every other type
+	mixed := []bson.M{
+		{"_id": bson.M{"$lt": "m"}},
+		{"_id": bson.M{"$gte": "m"}},
+	}
+	for _, t := range idTypes {
+		if t != bsonString {
+			mixed = append(mixed, bson.M{"_id": bson.M{"$type": t}})
+		}
+	}
+
+	data := []struct {
+		points    []interface{}
+		mixed     bool
+		selectors []bson.M
+	}{
+		{
+			[]interface{}{a, a, b},
+			false,
+			[]bson.M{
+				{"_id": bson.M{"$lt": a}},
+				{"_id": bson.M{"$gte": a, "$lt": b}},
+				{"_id": bson.M{"$gte": b}},
+			},
+		},
+		{[]interface{}{"m"}, true, mixed},
+		{[]interface{}{}, false, nil},
+		{[]interface{}{1, 2}, false, nil},
+		{[]interface{}{"m", a}, false, nil},
+	}
+
+	for _, v := range data {
+		var selectors []bson.M
+		for _, r := range buildRanges(v.points, v.mixed) {
+			selectors = append(selectors, r.selector())
+		}
+		if !reflect.DeepEqual(selectors, v.selectors) {
+			t.Errorf("expected:\n%+v\ngot:\n%+v\n", v.selectors, selectors)
+		}
+	}
+
+	// a range that's been partly sent picks up after the last _id
+	r := buildRanges([]interface{}{"m"}, true)[1]
+	r.last = "p"
+	if expected := (bson.M{"_id": bson.M{"$gt": "p"}}); !reflect.DeepEqual(r.selector(), expected) {
+		t.Errorf("expected:\n%+v\ngot:\n%+v\n", expected, r.selector())
+	}
+
+	// and so does a range that holds a whole type
+	r = buildRanges([]interface{}{"m"}, true)[2]
+	r.last = 5
+	if expected := (bson.M{"_id": bson.M{"$type": r.bsonType, "$gt": 5}}); !reflect.DeepEqual(r.selector(), expected) {
+		t.Errorf("expected:\n%+v\ngot:\n%+v\n", expected, r.selector())
+	}
+}
@@ -4,13 +4,24 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/compose/transporter/pkg/message"
 	"github.com/compose/transporter/pkg/pipe"
 	gorethink "github.com/dancannon/gorethink"
+	"gopkg.in/mgo.v2/bson"
 )
 
+// the ways the sink can prepare a table, before it writes to it for the first time
+const (
+	tableCreateIfMissing = "create_if_missing" // create the table if it isn't there, and leave it alone if it is
+	tableTruncate        = "truncate"          // create the table if it isn't there, and empty it if it is
+	tableDropAndCreate   = "drop_and_create"   // drop the table, and create it again
+)
+
+const defaultRethinkPort = "28015"
+
 // Rethinkdb is an adaptor that writes metrics to rethinkdb (http://rethinkdb.com/)
 // An open-source distributed database
 type Rethinkdb struct {
@@ -21,6 +32,16 @@ type Rethinkdb struct {
 	database string
 	table    string
 
+	// the database and table of each message, when the namespace is a template
+	target *namespaceTemplate
+
+	// how tables are prepared, and the tables that have been, keyed by database.table
+	tableMode string
+	prepared  map[string]bool
+
+	// follow the table's changefeed once it's been read
+	tail bool
+
 	debug bool
 
 	//
@@ -29,12 +50,16 @@ type Rethinkdb struct {
 
 	// rethinkdb connection and options
 	client *gorethink.Session
+	batch  *batch // nil when inserts are written one at a time
+
+	cursor   *gorethink.Cursor // the source's cursor, closed to stop it
+	cursorMu sync.Mutex
 }
 
 // NewRethinkdb creates a new Rethinkdb database adaptor
 func NewRethinkdb(p *pipe.Pipe, path string, extra Config) (StopStartListener, error) {
 	var (
-		conf dbConfig
+		conf RethinkdbConfig
 		err  error
 	)
 	if err = extra.Construct(&conf); err != nil {
@@ -47,23 +72,41 @@ func NewRethinkdb(p *pipe.Pipe, path string, extra Config) (StopStartListener, e
 	}
 
 	r := &Rethinkdb{
-		uri:  u,
-		pipe: p,
-		path: path,
+		uri:       u,
+		pipe:      p,
+		path:      path,
+		tableMode: conf.TableMode,
+		prepared:  map[string]bool{},
+		tail:      conf.Tail,
 	}
 
-	r.database, r.table, err = extra.splitNamespace()
+	switch r.tableMode {
+	case "":
+		r.tableMode = tableCreateIfMissing
+	case tableCreateIfMissing, tableTruncate, tableDropAndCreate:
+	default:
+		return r, fmt.Errorf("unknown table_mode %s, expected %s, %s or %s", r.tableMode, tableCreateIfMissing, tableTruncate, tableDropAndCreate)
+	}
+
+	r.target, err = newNamespaceTemplate(conf.Namespace)
 	if err != nil {
 		return r, err
 	}
+	r.database, r.table = r.target.first.raw, r.target.second.raw
 	r.debug = conf.Debug
 
-	return r, nil
-}
+	if conf.BulkSize > 1 {
+		var interval time.Duration
+		if conf.FlushInterval != "" {
+			interval, err = time.ParseDuration(conf.FlushInterval)
+			if err != nil {
+				return r, fmt.Errorf("malformed flush_interval (%s)", err.Error())
+			}
+		}
+		r.batch = newBatch(conf.BulkSize, interval, r.writeBatch)
+	}
 
-// Start the adaptor as a source (not implemented)
-func (r *Rethinkdb) Start() error {
-	return fmt.Errorf("Rethinkdb can't function as a source")
+	return r, nil
 }
 
 // Listen start's the adaptor's listener
@@ -74,41 +117,165 @@ func (r *Rethinkdb) Listen() (err error) {
 		return err
 	}
 
+	if !r.target.dynamic() { // we don't know the tables we'll write to until the messages arrive
+		if err = r.prepareTable(r.database, r.table); err != nil {
+			r.pipe.Err <- NewError(CRITICAL, r.path, fmt.Sprintf("Rethinkdb error (%s)", err.Error()), nil)
+			return err
+		}
+	}
+
+	defer func() {
+		r.Stop()
+	}()
+	if r.batch != nil {
+		r.batch.start()
+	}
 	return r.pipe.Listen(r.applyOp)
 }
 
-// Stop the adaptor
+// Stop the adaptor, and write any buffered inserts
 func (r *Rethinkdb) Stop() error {
 	r.pipe.Stop()
+	if r.batch != nil {
+		r.batch.stop()
+	}
+	r.closeCursor()
 	return nil
 }
 
-// applyOp applies one operation to the database
+// applyOp applies one operation to the database.  inserts are buffered when batching is on, and
+// the buffer is written out before anything else, so that the operations are applied in order.
+// operations that fail are reported, and don't stop the sink
 func (r *Rethinkdb) applyOp(msg *message.Msg) (*message.Msg, error) {
-	var (
-		resp gorethink.WriteResponse
-		err  error
-	)
+	if msg.Op == message.Command {
+		if _, hasKey := msg.Document()["flush"]; hasKey && r.batch != nil {
+			r.batch.flush()
+		}
+		return msg, nil
+	}
 
+	if err := r.write(msg); err != nil {
+		r.pipe.Err <- NewError(ERROR, r.path, fmt.Sprintf("Rethinkdb error (%s)", err.Error()), msg.Document())
+	}
+	return msg, nil
+}
+
+// write applies the message to the table it's headed for.  rows are written and looked up by the
+// message's id as a string, so an ObjectId is the same id whether it's inserted, updated or deleted
+func (r *Rethinkdb) write(msg *message.Msg) error {
+	database, table, err := r.target.execute(msg)
+	if err != nil {
+		return err
+	}
+	if err = r.prepareTable(database, table); err != nil {
+		return err
+	}
+
+	if r.batch != nil {
+		if msg.Op == message.Insert {
+			r.batch.add(database+"."+table, msg)
+			return nil
+		}
+		r.batch.flush()
+	}
+
+	var resp gorethink.WriteResponse
 	switch msg.Op {
 	case message.Delete:
-		resp, err = gorethink.Table(r.table).Get(msg.IDString()).Delete().RunWrite(r.client)
+		resp, err = gorethink.Db(database).Table(table).Get(msg.IDString()).Delete().RunWrite(r.client)
 	case message.Insert:
-		resp, err = gorethink.Table(r.table).Insert(msg.Document()).RunWrite(r.client)
+		return r.insert(database, table, []interface{}{rethinkDoc(msg)})
 	case message.Update:
-		resp, err = gorethink.Table(r.table).Insert(msg.DocumentWithID("id"), gorethink.InsertOpts{Conflict: "replace"}).RunWrite(r.client)
+		if modifierOnly(msg) {
+			return r.applyModifier(database, table, msg)
+		}
+		resp, err = gorethink.Db(database).Table(table).Insert(rethinkDoc(msg), gorethink.InsertOpts{Conflict: "replace"}).RunWrite(r.client)
 	}
 	if err != nil {
-		return msg, err
+		return err
 	}
+	return r.handleResponse(&resp)
+}
 
-	return msg, r.handleResponse(&resp)
+// rethinkDoc is the message's document as it's written to rethinkdb, with the id as a string under rethinkdb's
+// primary key, id.  the message's own document is left alone
+func rethinkDoc(msg *message.Msg) bson.M {
+	doc := bson.M{}
+	for k, v := range msg.Document() {
+		doc[k] = v
+	}
+	delete(doc, "_id")
+	if msg.ID != nil {
+		doc["id"] = msg.IDString()
+	}
+	return doc
+}
+
+// applyModifier applies an update that only carries a modifier to the row, rather than replacing the row with the
+// document, which only holds the id.  the fields the modifier sets are merged into the row, and then the row is
+// replaced with itself, without the fields it unsets
+func (r *Rethinkdb) applyModifier(database, table string, msg *message.Msg) error {
+	row := gorethink.Db(database).Table(table).Get(msg.IDString())
+	set, unset := rethinkModifier(msg.Modifier)
+
+	if len(set) > 0 {
+		resp, err := row.Update(set).RunWrite(r.client)
+		if err != nil {
+			return err
+		}
+		if err = r.handleResponse(&resp); err != nil {
+			return err
+		}
+	}
+	if len(unset) > 0 {
+		resp, err := row.Replace(gorethink.Row.Without(unset)).RunWrite(r.client)
+		if err != nil {
+			return err
+		}
+		return r.handleResponse(&resp)
+	}
+	return nil
+}
+
+// rethinkModifier turns the modifier's dotted paths into the nested documents rethinkdb's update and without take.
+// unset fields map to true, i.e. {"address": {"city": true}} for address.city
+func rethinkModifier(mod *message.Modifier) (set, unset bson.M) {
+	set, unset = bson.M{}, bson.M{}
+	for field, value := range mod.Set {
+		setField(set, strings.Split(field, "."), value)
+	}
+	for _, field := range mod.Unset {
+		setField(unset, strings.Split(field, "."), true)
+	}
+	return set, unset
+}
+
+// writeBatch writes a table's buffered inserts with one insert.  the key is the table's database.table
+func (r *Rethinkdb) writeBatch(key string, items []interface{}) {
+	docs := make([]interface{}, len(items))
+	for i, item := range items {
+		docs[i] = rethinkDoc(item.(*message.Msg))
+	}
+	names := strings.SplitN(key, ".", 2)
+	if err := r.insert(names[0], names[1], docs); err != nil {
+		r.pipe.Err <- NewError(ERROR, r.path, fmt.Sprintf("Rethinkdb error (insert of %d documents into %s failed, %s)", len(docs), key, err.Error()), nil)
+	}
+}
+
+// insert writes the documents to the table with one insert
+func (r *Rethinkdb) insert(database, table string, docs []interface{}) error {
+	resp, err := gorethink.Db(database).Table(table).Insert(docs).RunWrite(r.client)
+	if err != nil {
+		return err
+	}
+	return r.handleResponse(&resp)
 }
 
 func (r *Rethinkdb) setupClient() (*gorethink.Session, error) {
-	// set up the clientConfig, we need host:port, username, password, and database name
+	// set up the clientConfig, we need host:port, auth key, and database name
 	client, err := gorethink.Connect(gorethink.ConnectOpts{
-		Address:     r.uri.Host,
+		Address:     rethinkAddress(r.uri),
+		AuthKey:     rethinkAuthKey(r.uri),
 		MaxIdle:     10,
 		IdleTimeout: time.Second * 10,
 	})
@@ -116,13 +283,64 @@ func (r *Rethinkdb) setupClient() (*gorethink.Session, error) {
 		return nil, fmt.Errorf("Unable to connect: %s", err)
 	}
 
-	gorethink.Db(r.database).TableDrop(r.table).RunWrite(client)
-	gorethink.Db(r.database).TableCreate(r.table).RunWrite(client)
-
-	client.Use(r.database)
+	if !r.target.dynamic() {
+		client.Use(r.database)
+	}
 	return client, nil
 }
 
+// prepareTable gets a table ready the first time the sink writes to it, creating, emptying or
+// recreating it depending on the table mode
+func (r *Rethinkdb) prepareTable(database, table string) error {
+	if r.prepared[database+"."+table] {
+		return nil
+	}
+
+	if r.tableMode == tableDropAndCreate {
+		gorethink.Db(database).TableDrop(table).RunWrite(r.client) // it's fine if it isn't there
+	} else {
+		exists, err := r.tableExists(database, table)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if r.tableMode == tableTruncate {
+				if _, err := gorethink.Db(database).Table(table).Delete().RunWrite(r.client); err != nil {
+					return fmt.Errorf("can't truncate %s.%s (%s)", database, table, err.Error())
+				}
+			}
+			r.prepared[database+"."+table] = true
+			return nil
+		}
+	}
+
+	if _, err := gorethink.Db(database).TableCreate(table).RunWrite(r.client); err != nil {
+		return fmt.Errorf("can't create %s.%s (%s)", database, table, err.Error())
+	}
+	r.prepared[database+"."+table] = true
+	return nil
+}
+
+// tableExists checks the database's table list for the table
+func (r *Rethinkdb) tableExists(database, table string) (bool, error) {
+	cursor, err := gorethink.Db(database).TableList().Run(r.client)
+	if err != nil {
+		return false, fmt.Errorf("can't list the tables in %s (%s)", database, err.Error())
+	}
+	defer cursor.Close()
+
+	var tables []string
+	if err := cursor.All(&tables); err != nil {
+		return false, fmt.Errorf("can't list the tables in %s (%s)", database, err.Error())
+	}
+	for _, t := range tables {
+		if t == table {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // handleresponse takes the rethink response and turn it into something we can consume elsewhere
 func (r *Rethinkdb) handleResponse(resp *gorethink.WriteResponse) error {
 	if resp.Errors != 0 {
@@ -135,3 +353,42 @@ func (r *Rethinkdb) handleResponse(resp *gorethink.WriteResponse) error {
 	}
 	return nil
 }
+
+// rethinkAddress is the host and port of the uri, with the default driver port when there isn't one
+func rethinkAddress(uri *url.URL) string {
+	if strings.Contains(uri.Host, ":") {
+		return uri.Host
+	}
+	return uri.Host + ":" + defaultRethinkPort
+}
+
+// rethinkAuthKey is the auth key in the uri, either as the password, rethinkdb://:key@host/db,
+// or on its own, rethinkdb://key@host/db
+func rethinkAuthKey(uri *url.URL) string {
+	if uri.User == nil {
+		return ""
+	}
+	if key, ok := uri.User.Password(); ok {
+		return key
+	}
+	return uri.User.Username()
+}
+
+// RethinkdbConfig provides configuration options for a rethinkdb adaptor
+type RethinkdbConfig struct {
+	URI       string `json:"uri"`       // the uri of the server, i.e. rethinkdb://:authkey@localhost:28015/db
+	Namespace string `json:"namespace"` // the database.table to write to, which can be a template
+	Debug     bool   `json:"debug"`
+
+	// TableMode is how the sink prepares each table before it writes to it, create_if_missing by default, which leaves
+	// tables that exist alone.  truncate empties tables that exist, and drop_and_create drops them and creates them again
+	TableMode string `json:"table_mode"`
+
+	// Tail follows the table's changefeed once the table has been read, sending the inserts, updates and deletes made to it
+	Tail bool `json:"tail"`
+
+	// BulkSize buffers up to this many inserts, and writes them with one insert.  inserts are written one at a time
+	// when this is 0 or 1.  FlushInterval is the longest that buffered inserts wait before they're written, i.e. "500ms"
+	BulkSize      int    `json:"bulk_size"`
+	FlushInterval string `json:"flush_interval"`
+}
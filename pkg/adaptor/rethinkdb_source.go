@@ -0,0 +1,145 @@
+package adaptor
+
+import (
+	"fmt"
+
+	"github.com/compose/transporter/pkg/message"
+	gorethink "github.com/dancannon/gorethink"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// a rethinkChange is one document from a changefeed.  inserts only have a new value, deletes only have an old one,
+// and updates have both.  with include_initial, the table's documents come first, as inserts, followed by a
+// state document once they've all been sent
+type rethinkChange struct {
+	OldVal map[string]interface{} `gorethink:"old_val"`
+	NewVal map[string]interface{} `gorethink:"new_val"`
+	State  string                 `gorethink:"state"`
+}
+
+// Start the adaptor as a source.  the table is read and each document is sent as an insert.  with tail, the table is
+// read through its changefeed, with include_initial, so there's no gap between the read and the changes that follow it,
+// and the inserts, updates and deletes made to the table are sent until the adaptor is stopped
+func (r *Rethinkdb) Start() (err error) {
+	defer func() {
+		r.pipe.Stop()
+	}()
+
+	if r.target.dynamic() {
+		err = NewError(CRITICAL, r.path, "Rethinkdb error (a source can't read from a templated namespace)", nil)
+		r.pipe.Err <- err
+		return err
+	}
+
+	r.client, err = r.setupClient()
+	if err != nil {
+		r.pipe.Err <- NewError(CRITICAL, r.path, fmt.Sprintf("Rethinkdb error (%s)", err.Error()), nil)
+		return err
+	}
+
+	if r.tail {
+		err = r.readChanges()
+	} else {
+		err = r.readTable()
+	}
+	if err != nil {
+		r.pipe.Err <- err
+	}
+	return err
+}
+
+// readTable sends every document in the table as an insert
+func (r *Rethinkdb) readTable() error {
+	cursor, err := r.openCursor(gorethink.Db(r.database).Table(r.table))
+	if err != nil {
+		return err
+	}
+	defer r.closeCursor()
+
+	var doc map[string]interface{}
+	for cursor.Next(&doc) {
+		if stop := r.pipe.Stopped; stop {
+			return nil
+		}
+		r.pipe.Send(r.changeMsg(rethinkChange{NewVal: doc}))
+		doc = nil
+	}
+	if err := cursor.Err(); err != nil && !r.pipe.Stopped {
+		return NewError(CRITICAL, r.path, fmt.Sprintf("Rethinkdb error (error reading %s.%s %s)", r.database, r.table, err.Error()), nil)
+	}
+
+	r.pipe.Send(message.NewMsg(message.Command, bson.M{"flush": true, "copied": true}))
+	return nil
+}
+
+// readChanges follows the table's changefeed, starting with the documents already in the table
+func (r *Rethinkdb) readChanges() error {
+	feed := gorethink.Db(r.database).Table(r.table).Changes(gorethink.ChangesOpts{IncludeInitial: true, IncludeStates: true})
+	cursor, err := r.openCursor(feed)
+	if err != nil {
+		return err
+	}
+	defer r.closeCursor()
+
+	var change rethinkChange
+	for cursor.Next(&change) {
+		if stop := r.pipe.Stopped; stop {
+			return nil
+		}
+		if change.State == "ready" { // the initial documents have all been sent
+			r.pipe.Send(message.NewMsg(message.Command, bson.M{"flush": true, "copied": true}))
+		}
+		if msg := r.changeMsg(change); msg != nil {
+			r.pipe.Send(msg)
+		}
+		change = rethinkChange{}
+	}
+	if err := cursor.Err(); err != nil && !r.pipe.Stopped {
+		return NewError(CRITICAL, r.path, fmt.Sprintf("Rethinkdb error (error reading changes to %s.%s %s)", r.database, r.table, err.Error()), nil)
+	}
+	return nil
+}
+
+// changeMsg builds the message for a change.  returns nil for changes that don't carry a document, i.e. states
+func (r *Rethinkdb) changeMsg(change rethinkChange) *message.Msg {
+	var (
+		op  message.OpType
+		doc map[string]interface{}
+	)
+	switch {
+	case change.OldVal == nil && change.NewVal == nil:
+		return nil
+	case change.OldVal == nil:
+		op, doc = message.Insert, change.NewVal
+	case change.NewVal == nil:
+		op, doc = message.Delete, change.OldVal
+	default:
+		op, doc = message.Update, change.NewVal
+	}
+
+	msg := message.NewMsg(op, fromJSON(doc).(bson.M))
+	msg.Namespace = r.database + "." + r.table
+	return msg
+}
+
+// openCursor runs the query, and keeps the cursor so that Stop can close it
+func (r *Rethinkdb) openCursor(query gorethink.Term) (*gorethink.Cursor, error) {
+	cursor, err := query.Run(r.client)
+	if err != nil {
+		return nil, NewError(CRITICAL, r.path, fmt.Sprintf("Rethinkdb error (can't read %s.%s %s)", r.database, r.table, err.Error()), nil)
+	}
+	r.cursorMu.Lock()
+	r.cursor = cursor
+	r.cursorMu.Unlock()
+	return cursor, nil
+}
+
+// closeCursor closes the source's cursor, which ends a changefeed that's waiting for the next change
+func (r *Rethinkdb) closeCursor() {
+	r.cursorMu.Lock()
+	defer r.cursorMu.Unlock()
+	if r.cursor != nil {
+		r.cursor.Close()
+		r.cursor = nil
+	}
+}
@@ -0,0 +1,139 @@
+package adaptor
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNewRethinkdb(t *testing.T) {
+	data := []struct {
+		extra     Config
+		tableMode string
+		batch     bool
+		err       bool
+	}{
+		{Config{"uri": "rethinkdb://localhost/boom", "namespace": "boom.foo"}, tableCreateIfMissing, false, false},
+		{Config{"uri": "rethinkdb://localhost/boom", "namespace": "boom.foo", "table_mode": "truncate", "bulk_size": 100}, tableTruncate, true, false},
+		{Config{"uri": "rethinkdb://localhost/boom", "namespace": "boom.foo", "table_mode": "drop_and_create"}, tableDropAndCreate, false, false},
+		{Config{"uri": "rethinkdb://localhost/boom", "namespace": "boom.foo", "table_mode": "drop"}, "", false, true},
+		{Config{"uri": "rethinkdb://localhost/boom", "namespace": "boom.foo", "bulk_size": 100, "flush_interval": "soon"}, "", false, true},
+		{Config{"uri": "rethinkdb://localhost/boom", "namespace": "boom"}, "", false, true},
+	}
+
+	for _, v := range data {
+		a, err := Createadaptor("rethinkdb", "rethink", v.extra, pipe.NewPipe(nil, "rethink"))
+		if (err != nil) != v.err {
+			t.Errorf("%v: expected error to be %v, got %v", v.extra, v.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		r := a.(*Rethinkdb)
+		if r.tableMode != v.tableMode || (r.batch != nil) != v.batch {
+			t.Errorf("%v: expected table mode %s and batching %v, got %s and %v", v.extra, v.tableMode, v.batch, r.tableMode, r.batch != nil)
+		}
+	}
+}
+
+func TestRethinkURI(t *testing.T) {
+	data := []struct {
+		in      string
+		address string
+		authKey string
+	}{
+		{"rethinkdb://localhost/boom", "localhost:28015", ""},
+		{"rethinkdb://:secret@localhost:28016/boom", "localhost:28016", "secret"},
+		{"rethinkdb://secret@localhost/boom", "localhost:28015", "secret"},
+	}
+
+	for _, v := range data {
+		u, _ := url.Parse(v.in)
+		if address, authKey := rethinkAddress(u), rethinkAuthKey(u); address != v.address || authKey != v.authKey {
+			t.Errorf("%s: expected %s %s, got %s %s", v.in, v.address, v.authKey, address, authKey)
+		}
+	}
+}
+
+func TestRethinkModifier(t *testing.T) {
+	mod := &message.Modifier{Set: bson.M{"name": "c", "address.city": "x"}, Unset: []string{"old", "address.zip"}}
+	set, unset := rethinkModifier(mod)
+
+	if expected := (bson.M{"name": "c", "address": bson.M{"city": "x"}}); !reflect.DeepEqual(set, expected) {
+		t.Errorf("expected set %v, got %v", expected, set)
+	}
+	if expected := (bson.M{"old": true, "address": bson.M{"zip": true}}); !reflect.DeepEqual(unset, expected) {
+		t.Errorf("expected unset %v, got %v", expected, unset)
+	}
+}
+
+func TestRethinkIDs(t *testing.T) {
+	id := bson.NewObjectId()
+
+	insert := rethinkDoc(message.NewMsg(message.Insert, bson.M{"_id": id, "name": "a"}))
+	if expected := (bson.M{"id": id.Hex(), "name": "a"}); !reflect.DeepEqual(insert, expected) {
+		t.Errorf("expected the insert to write %v, got %v", expected, insert)
+	}
+	update := rethinkDoc(message.NewMsg(message.Update, bson.M{"_id": id, "name": "b"}))
+	if expected := (bson.M{"id": id.Hex(), "name": "b"}); !reflect.DeepEqual(update, expected) {
+		t.Errorf("expected the update to write %v, got %v", expected, update)
+	}
+	if got := message.NewMsg(message.Delete, bson.M{"_id": id}).IDString(); got != id.Hex() {
+		t.Errorf("expected the delete to get %s, got %s", id.Hex(), got)
+	}
+
+	msg := message.NewMsg(message.Insert, bson.M{"_id": id, "name": "a"})
+	rethinkDoc(msg)
+	if expected := (bson.M{"_id": id, "name": "a"}); !reflect.DeepEqual(msg.Document(), expected) {
+		t.Errorf("expected the message's document to be left alone, got %v", msg.Document())
+	}
+}
+
+func TestRethinkChangeMsg(t *testing.T) {
+	r := &Rethinkdb{database: "boom", table: "foo"}
+
+	data := []struct {
+		change rethinkChange
+		op     message.OpType
+		doc    bson.M
+	}{
+		{
+			rethinkChange{NewVal: map[string]interface{}{"id": "a", "count": float64(1), "address": map[string]interface{}{"city": "ny"}}},
+			message.Insert,
+			bson.M{"id": "a", "count": float64(1), "address": bson.M{"city": "ny"}},
+		},
+		{
+			rethinkChange{OldVal: map[string]interface{}{"id": "a", "count": float64(1)}, NewVal: map[string]interface{}{"id": "a", "count": float64(2)}},
+			message.Update,
+			bson.M{"id": "a", "count": float64(2)},
+		},
+		{
+			rethinkChange{OldVal: map[string]interface{}{"id": "a", "count": float64(2)}},
+			message.Delete,
+			bson.M{"id": "a", "count": float64(2)},
+		},
+	}
+
+	for _, v := range data {
+		msg := r.changeMsg(v.change)
+		if msg == nil {
+			t.Errorf("%+v: expected a message", v.change)
+			continue
+		}
+		if msg.Op != v.op || msg.Namespace != "boom.foo" || msg.IDString() != "a" {
+			t.Errorf("%+v: expected a %s of a to boom.foo, got a %s of %s to %s", v.change, v.op, msg.Op, msg.IDString(), msg.Namespace)
+		}
+		if !reflect.DeepEqual(msg.Document(), v.doc) {
+			t.Errorf("%+v: expected %v, got %v", v.change, v.doc, msg.Document())
+		}
+	}
+
+	if msg := r.changeMsg(rethinkChange{State: "ready"}); msg != nil {
+		t.Errorf("expected no message for a state change, got %+v", msg)
+	}
+}
@@ -0,0 +1,269 @@
+package adaptor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// a template is a string with placeholders in braces that are filled in from each message.
+// placeholders can be
+//   {db} and {collection}, the two halves of the namespace the message was read from
+//   {namespace}, the whole namespace the message was read from
+//   {doc.field}, the value of a field in the document.  nested fields are dotted, {doc.address.city}.  updates that
+//     only carry a modifier fill it in from the fields they set, and deletes only from the fields their source sends
+//   {timestamp}, the message's timestamp, in seconds since the epoch
+// a placeholder followed by a go time layout, {timestamp:2006.01.02} or {doc.created_at:2006-01}, formats the value as a date
+// in UTC.  document fields can be dates, RFC 3339 strings, or numbers of seconds since the epoch
+type template struct {
+	raw   string
+	parts []templatePart
+}
+
+// templatePart is either literal text, or a placeholder with an optional time layout
+type templatePart struct {
+	literal     string
+	placeholder string
+	layout      string
+}
+
+// newTemplate parses the template string
+func newTemplate(raw string) (*template, error) {
+	t := &template{raw: raw}
+
+	for s := raw; len(s) > 0; {
+		open := strings.Index(s, "{")
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: s})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: s[:open]})
+		}
+
+		end := strings.Index(s[open:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("malformed template %s, missing '}'", raw)
+		}
+		placeholder, layout := s[open+1:open+end], ""
+		if i := strings.Index(placeholder, ":"); i >= 0 {
+			placeholder, layout = placeholder[:i], placeholder[i+1:]
+			if layout == "" {
+				return nil, fmt.Errorf("malformed template %s, empty time layout in {%s}", raw, s[open+1:open+end])
+			}
+		}
+		if !validPlaceholder(placeholder) {
+			return nil, fmt.Errorf("malformed template %s, unknown placeholder {%s}", raw, placeholder)
+		}
+		t.parts = append(t.parts, templatePart{placeholder: placeholder, layout: layout})
+
+		s = s[open+end+1:]
+	}
+	return t, nil
+}
+
+func validPlaceholder(placeholder string) bool {
+	switch {
+	case placeholder == "db", placeholder == "collection", placeholder == "namespace", placeholder == "timestamp":
+		return true
+	case strings.HasPrefix(placeholder, "doc.") && len(placeholder) > len("doc."):
+		return true
+	}
+	return false
+}
+
+// dynamic returns true if the template has any placeholders
+func (t *template) dynamic() bool {
+	for _, part := range t.parts {
+		if part.placeholder != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// execute fills in the template's placeholders from the message
+func (t *template) execute(msg *message.Msg) (string, error) {
+	var out string
+	for _, part := range t.parts {
+		if part.placeholder == "" {
+			out += part.literal
+			continue
+		}
+
+		value, err := part.value(msg)
+		if err != nil {
+			return "", fmt.Errorf("can't fill in template %s (%s)", t.raw, err.Error())
+		}
+		out += value
+	}
+	return out, nil
+}
+
+// value fills in the placeholder from the message, formatted as a date if the part has a layout
+func (p templatePart) value(msg *message.Msg) (string, error) {
+	if p.layout == "" {
+		return placeholderValue(p.placeholder, msg)
+	}
+
+	var value interface{} = msg.Timestamp
+	if strings.HasPrefix(p.placeholder, "doc.") {
+		var err error
+		if value, err = docField(msg, strings.TrimPrefix(p.placeholder, "doc.")); err != nil {
+			return "", err
+		}
+	} else if p.placeholder != "timestamp" {
+		return "", fmt.Errorf("{%s} can't be formatted as a date", p.placeholder)
+	}
+
+	t, err := asTime(value)
+	if err != nil {
+		return "", fmt.Errorf("%s isn't a date (%s)", p.placeholder, err.Error())
+	}
+	return t.UTC().Format(p.layout), nil
+}
+
+// asTime converts a date, an RFC 3339 string, or a number of seconds since the epoch to a time
+func asTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return time.Parse(time.RFC3339, v)
+	case bson.MongoTimestamp:
+		return time.Unix(int64(v)>>32, 0), nil
+	}
+	if n, ok := toFloat(value); ok {
+		return time.Unix(int64(n), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("unexpected %T", value)
+}
+
+func placeholderValue(placeholder string, msg *message.Msg) (string, error) {
+	if strings.HasPrefix(placeholder, "doc.") {
+		value, err := docField(msg, strings.TrimPrefix(placeholder, "doc."))
+		if err != nil {
+			return "", err
+		}
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprintf("%v", value), nil
+	}
+	if placeholder == "timestamp" {
+		return fmt.Sprintf("%d", msg.Timestamp), nil
+	}
+
+	if msg.Namespace == "" {
+		return "", fmt.Errorf("message has no namespace")
+	}
+	if placeholder == "namespace" {
+		return msg.Namespace, nil
+	}
+
+	fields := strings.SplitN(msg.Namespace, ".", 2)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("malformed namespace %s", msg.Namespace)
+	}
+	if placeholder == "db" {
+		return fields[0], nil
+	}
+	return fields[1], nil
+}
+
+// docField finds the value of a field of the message's document.  an update that only carries a modifier only holds
+// the id, so the field is looked up in what the modifier sets.  a delete only holds what its source sent, which is
+// just the id for mongo, so fields other than the id can only be filled in for deletes from sources that send the
+// whole document, and the error says so
+func docField(msg *message.Msg, path string) (interface{}, error) {
+	if value, ok := lookupField(msg.Document(), path); ok {
+		return value, nil
+	}
+	if msg.Modifier != nil {
+		if value := msg.Modifier.Set[path]; value != nil {
+			return value, nil
+		}
+		if value, ok := lookupField(msg.Modifier.Set, path); ok {
+			return value, nil
+		}
+	}
+	if msg.Op == message.Delete {
+		return nil, fmt.Errorf("document has no field %s, and a delete only carries the fields its source sends", path)
+	}
+	return nil, fmt.Errorf("document has no field %s", path)
+}
+
+// lookupField finds the value of a dotted field path in a document
+func lookupField(doc bson.M, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, field := range strings.Split(path, ".") {
+		switch d := value.(type) {
+		case bson.M:
+			value = d[field]
+		case map[string]interface{}:
+			value = d[field]
+		default:
+			return nil, false
+		}
+		if value == nil {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// namespaceTemplate is a namespace, i.e. db.collection or index.type, where either half can be a template.
+// sinks use them to choose where each message is written to
+type namespaceTemplate struct {
+	first  *template
+	second *template
+}
+
+// newNamespaceTemplate splits the namespace on the first '.' that isn't part of a placeholder, and
+// parses each half as a template
+func newNamespaceTemplate(namespace string) (*namespaceTemplate, error) {
+	depth := 0
+	for i, c := range namespace {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '.':
+			if depth > 0 {
+				continue
+			}
+			first, err := newTemplate(namespace[:i])
+			if err != nil {
+				return nil, err
+			}
+			second, err := newTemplate(namespace[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			return &namespaceTemplate{first: first, second: second}, nil
+		}
+	}
+	return nil, fmt.Errorf("malformed namespace, expected a '.' deliminated string")
+}
+
+// dynamic returns true if either half of the namespace has placeholders
+func (n *namespaceTemplate) dynamic() bool {
+	return n.first.dynamic() || n.second.dynamic()
+}
+
+// execute fills in both halves of the namespace from the message
+func (n *namespaceTemplate) execute(msg *message.Msg) (string, string, error) {
+	first, err := n.first.execute(msg)
+	if err != nil {
+		return "", "", err
+	}
+	second, err := n.second.execute(msg)
+	if err != nil {
+		return "", "", err
+	}
+	return first, second, nil
+}
@@ -0,0 +1,144 @@
+package adaptor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNamespaceTemplate(t *testing.T) {
+	msg := message.NewMsg(message.Insert, bson.M{"_id": 1, "tenant": "acme", "address": bson.M{"city": "ny"}, "year": 2014})
+	msg.Namespace = "app.events.2014"
+
+	data := []struct {
+		namespace string
+		first     string
+		second    string
+		dynamic   bool
+		err       string
+	}{
+		{"boom.foo", "boom", "foo", false, ""},
+		{"{db}.{collection}", "app", "events.2014", true, ""},
+		{"{db}_copy.{collection}", "app_copy", "events.2014", true, ""},
+		{"logs-{doc.tenant}.{doc.address.city}", "logs-acme", "ny", true, ""},
+		{"{namespace}-{doc.year}.entry", "app.events.2014-2014", "entry", true, ""},
+		{"{doc.missing}.entry", "", "", true, "can't fill in template {doc.missing} (document has no field missing)"},
+	}
+
+	for _, v := range data {
+		tmpl, err := newNamespaceTemplate(v.namespace)
+		if err != nil {
+			t.Errorf("%s: got error %s", v.namespace, err)
+			continue
+		}
+		if tmpl.dynamic() != v.dynamic {
+			t.Errorf("%s: expected dynamic to be %v", v.namespace, v.dynamic)
+		}
+
+		first, second, err := tmpl.execute(msg)
+		if err != nil && err.Error() != v.err {
+			t.Errorf("%s: expected error: %v\ngot error: %v\n", v.namespace, v.err, err)
+		}
+		if first != v.first || second != v.second {
+			t.Errorf("%s: expected %s and %s, got %s and %s", v.namespace, v.first, v.second, first, second)
+		}
+	}
+}
+
+func TestTemplateFieldsOfPartialMessages(t *testing.T) {
+	update := message.NewMsg(message.Update, bson.M{"_id": 1})
+	update.Modifier = &message.Modifier{Set: bson.M{"tenant": "acme", "address.city": "ny"}}
+	update.ModifierOnly = true
+	deleted := message.NewMsg(message.Delete, bson.M{"_id": 1})
+
+	data := []struct {
+		msg      *message.Msg
+		template string
+		expected string
+		err      string
+	}{
+		{update, "logs-{doc.tenant}", "logs-acme", ""},
+		{update, "logs-{doc.address.city}", "logs-ny", ""},
+		{update, "logs-{doc.year}", "", "can't fill in template logs-{doc.year} (document has no field year)"},
+		{deleted, "logs-{doc._id}", "logs-1", ""},
+		{deleted, "logs-{doc.tenant}", "", "can't fill in template logs-{doc.tenant} (document has no field tenant, and a delete only carries the fields its source sends)"},
+	}
+
+	for _, v := range data {
+		tmpl, err := newTemplate(v.template)
+		if err != nil {
+			t.Errorf("%s: got error %s", v.template, err)
+			continue
+		}
+		got, err := tmpl.execute(v.msg)
+		if (err != nil || v.err != "") && (err == nil || err.Error() != v.err) {
+			t.Errorf("%s: expected error: %v\ngot error: %v\n", v.template, v.err, err)
+		}
+		if got != v.expected {
+			t.Errorf("%s: expected %s, got %s", v.template, v.expected, got)
+		}
+	}
+}
+
+func TestMalformedNamespaceTemplate(t *testing.T) {
+	data := []struct {
+		namespace string
+		err       string
+	}{
+		{"boom", "malformed namespace, expected a '.' deliminated string"},
+		{"{doc.tenant}", "malformed namespace, expected a '.' deliminated string"},
+		{"foo.{db", "malformed template {db, missing '}'"},
+		{"{database}.foo", "malformed template {database}, unknown placeholder {database}"},
+		{"{timestamp:}.foo", "malformed template {timestamp:}, empty time layout in {timestamp:}"},
+	}
+
+	for _, v := range data {
+		_, err := newNamespaceTemplate(v.namespace)
+		if err == nil || err.Error() != v.err {
+			t.Errorf("%s: expected error: %v\ngot error: %v\n", v.namespace, v.err, err)
+		}
+	}
+}
+
+func TestDateTemplate(t *testing.T) {
+	msg := message.NewMsg(message.Insert, bson.M{
+		"_id":     1,
+		"created": time.Date(2026, 10, 18, 23, 30, 0, 0, time.FixedZone("EST", -5*3600)),
+		"day":     "2026-01-02T03:04:05Z",
+		"epoch":   int64(1420070400),
+		"name":    "acme",
+	})
+	msg.Timestamp = time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC).Unix()
+	msg.Namespace = "app.events"
+
+	data := []struct {
+		template string
+		expected string
+		err      string
+	}{
+		{"events-{timestamp:2006.01.02}", "events-2026.03.04", ""},
+		{"events-{doc.created:2006.01.02}", "events-2026.10.19", ""}, // dates are formatted in UTC
+		{"events-{doc.day:2006-01}", "events-2026-01", ""},
+		{"events-{doc.epoch:2006}", "events-2015", ""},
+		{"{collection}-{timestamp}", "events-1772600767", ""},
+		{"events-{doc.name:2006}", "", "can't fill in template events-{doc.name:2006} (doc.name isn't a date (parsing time \"acme\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"acme\" as \"2006\"))"},
+		{"events-{db:2006}", "", "can't fill in template events-{db:2006} ({db} can't be formatted as a date)"},
+	}
+
+	for _, v := range data {
+		tmpl, err := newTemplate(v.template)
+		if err != nil {
+			t.Errorf("%s: got error %s", v.template, err)
+			continue
+		}
+		got, err := tmpl.execute(msg)
+		if (err != nil || v.err != "") && (err == nil || err.Error() != v.err) {
+			t.Errorf("%s: expected error: %v\ngot error: %v\n", v.template, v.err, err)
+		}
+		if got != v.expected {
+			t.Errorf("%s: expected %s, got %s", v.template, v.expected, got)
+		}
+	}
+}
@@ -102,6 +102,10 @@ func (t *Transformer) transformOne(msg *message.Msg) (*message.Msg, error) {
 	if msg.Op == message.Delete || msg.Op == message.Command {
 		return msg, nil
 	}
+	if modifierOnly(msg) { // there's no document to transform
+		t.pipe.Err <- t.transformerError(ERROR, errModifierOnly, msg)
+		return msg, nil
+	}
 
 	now := time.Now().Nanosecond()
 
@@ -138,6 +142,7 @@ func (t *Transformer) transformOne(msg *message.Msg) (*message.Msg, error) {
 			return msg, nil
 		}
 		msg.SetDocument(doc)
+		msg.Modifier = nil // the modifier described the document before it was transformed
 	default:
 		if t.debug {
 			fmt.Println("transformer skipping doc")
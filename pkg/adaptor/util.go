@@ -0,0 +1,53 @@
+package adaptor
+
+import (
+	"encoding/json"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fromJSON converts decoded json into bson types.  objects become bson.M, and numbers become
+// int64s when they're whole, and float64s when they aren't
+func fromJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		doc := bson.M{}
+		for k, v := range t {
+			doc[k] = fromJSON(v)
+		}
+		return doc
+	case []interface{}:
+		for i := range t {
+			t[i] = fromJSON(t[i])
+		}
+		return t
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
+
+// flattenDoc flattens nested documents into a single level, with dotted names.  fields that are null are left out
+func flattenDoc(doc map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range doc {
+		switch d := v.(type) {
+		case bson.M:
+			for field, value := range flattenDoc(d) {
+				out[k+"."+field] = value
+			}
+		case map[string]interface{}:
+			for field, value := range flattenDoc(d) {
+				out[k+"."+field] = value
+			}
+		case nil:
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
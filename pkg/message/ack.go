@@ -0,0 +1,41 @@
+// Copyright 2014 The Transporter Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package message
+
+import "sync/atomic"
+
+// An Ack lets a source know when every node downstream of it has handled a message.  the pipe counts each
+// delivery of the message, and each node that's done with it, and Acked is closed once they match.
+// a message sent after the ack is closed is handled after the acked one, so an acked flush means
+// everything sent before it has been written
+type Ack struct {
+	pending int64
+	done    chan struct{}
+}
+
+// NewAck returns an Ack that hasn't been delivered anywhere yet
+func NewAck() *Ack {
+	return &Ack{done: make(chan struct{})}
+}
+
+// Add records n more deliveries of the message.  it's safe to call on a nil Ack
+func (a *Ack) Add(n int) {
+	if a != nil {
+		atomic.AddInt64(&a.pending, int64(n))
+	}
+}
+
+// Done records that a node has handled the message, and closes Acked when it was the last one.
+// it's safe to call on a nil Ack
+func (a *Ack) Done() {
+	if a != nil && atomic.AddInt64(&a.pending, -1) == 0 {
+		close(a.done)
+	}
+}
+
+// Acked is closed once every node the message was delivered to has handled it
+func (a *Ack) Acked() <-chan struct{} {
+	return a.done
+}
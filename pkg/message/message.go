@@ -25,8 +25,30 @@ type Msg struct {
 	Op         OpType
 	ID         interface{}
 	OriginalID interface{}
+	Namespace  string // the namespace the document was read from, i.e. "db.collection"
 	document   bson.M // document is private
 	idKey      string // where the original id value is stored, either "_id" or "id"
+
+	// Modifier holds the partial update for Update messages, when the source knows it, alongside the whole
+	// document.  nil means the document is a whole replacement.  ModifierOnly means the source didn't fetch the
+	// document, it only holds the id, so the update can only be applied by a sink that understands the modifier
+	Modifier     *Modifier
+	ModifierOnly bool
+
+	// Version orders the changes made to a document, when the source knows it, i.e. the timestamp of
+	// the oplog entry for messages from mongo.  0 means the source doesn't know it
+	Version int64
+
+	// Ack is closed once every node has handled the message, when the source wants to know, and nil otherwise
+	Ack *Ack
+}
+
+// A Modifier describes a partial update to a document rather than a whole replacement.
+// Set holds the fields to change and their new values, and Unset lists the fields to remove.
+// field names can be dotted paths into nested documents, i.e. "address.city"
+type Modifier struct {
+	Set   bson.M
+	Unset []string
 }
 
 // NewMsg returns a new Msg with the ID extracted
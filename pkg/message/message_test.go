@@ -188,3 +188,26 @@ func TestOriginalIdOnSet(t *testing.T) {
 		}
 	}
 }
+
+func TestAck(t *testing.T) {
+	ack := NewAck()
+	ack.Add(2)
+	ack.Done()
+	ack.Add(1) // the first node passed it on
+	ack.Done()
+	select {
+	case <-ack.Acked():
+		t.Fatalf("expected the ack to wait for every delivery")
+	default:
+	}
+	ack.Done()
+	select {
+	case <-ack.Acked():
+	default:
+		t.Errorf("expected the ack to be closed once every delivery was done")
+	}
+
+	var none *Ack
+	none.Add(1)
+	none.Done()
+}
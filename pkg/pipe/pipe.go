@@ -91,10 +91,14 @@ func (m *Pipe) Listen(fn func(*message.Msg) (*message.Msg, error)) error {
 				return err
 			}
 			if len(m.Out) > 0 {
+				if outmsg != nil && outmsg.Ack == nil {
+					outmsg.Ack = msg.Ack // a replacement message is still acked for the original
+				}
 				m.Send(outmsg)
 			} else {
 				m.MessageCount++ // update the count anyway
 			}
+			msg.Ack.Done()
 		case <-time.After(100 * time.Millisecond):
 			// NOP, just breath
 		}
@@ -118,6 +122,9 @@ func (m *Pipe) Stop() {
 // Send emits the given message on the 'Out' channel.  the send Timesout after 100 ms in order to chaeck of the Pipe has stopped and we've been asked to exit.
 // If the Pipe has been stopped, the send will fail and there is no guarantee of either success or failure
 func (m *Pipe) Send(msg *message.Msg) {
+	if msg != nil {
+		msg.Ack.Add(len(m.Out)) // count every delivery up front, so an early Done can't close the ack
+	}
 	for _, ch := range m.Out {
 
 	A:
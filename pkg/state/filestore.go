@@ -0,0 +1,74 @@
+// Copyright 2014 The Transporter Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// FileStore is a Store that keeps every node's checkpoint in a single json file on the local disk.
+// The file is rewritten on every Save, by writing a temporary file and renaming it over the
+// original, so a crash will never leave a half written file behind.
+type FileStore struct {
+	filename    string
+	checkpoints map[string]int64
+
+	sync.Mutex
+}
+
+// NewFileStore creates a FileStore backed by the given filename, and loads any
+// checkpoints that have already been saved there
+func NewFileStore(filename string) (Store, error) {
+	f := &FileStore{
+		filename:    filename,
+		checkpoints: make(map[string]int64),
+	}
+
+	ba, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ba) > 0 {
+		if err = json.Unmarshal(ba, &f.checkpoints); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Save records the checkpoint for path, and writes the store out to disk
+func (f *FileStore) Save(path string, checkpoint int64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.checkpoints[path] = checkpoint
+
+	ba, err := json.Marshal(f.checkpoints)
+	if err != nil {
+		return err
+	}
+
+	tmp := f.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, ba, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.filename)
+}
+
+// Load returns the last checkpoint saved for path
+func (f *FileStore) Load(path string) (int64, bool, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	checkpoint, ok := f.checkpoints[path]
+	return checkpoint, ok, nil
+}
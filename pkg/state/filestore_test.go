@@ -0,0 +1,89 @@
+// Copyright 2014 The Transporter Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transporter-state")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "state")
+
+	data := []struct {
+		path       string
+		checkpoint int64
+	}{
+		{"source", 1},
+		{"source/sink", 2},
+		{"source", 3},
+	}
+
+	s, err := NewFileStore(filename)
+	if err != nil {
+		t.Fatalf("can't create store: %s", err)
+	}
+	for _, v := range data {
+		if err := s.Save(v.path, v.checkpoint); err != nil {
+			t.Errorf("can't save %s: %s", v.path, err)
+		}
+	}
+
+	// a fresh store should pick up what the last one wrote
+	s, err = NewFileStore(filename)
+	if err != nil {
+		t.Fatalf("can't reopen store: %s", err)
+	}
+
+	expected := map[string]int64{"source": 3, "source/sink": 2}
+	for path, want := range expected {
+		got, ok, err := s.Load(path)
+		if err != nil || !ok {
+			t.Errorf("Load(%s) failed, ok: %v, err: %v", path, ok, err)
+		}
+		if got != want {
+			t.Errorf("Load(%s) expected %d, got %d", path, want, got)
+		}
+	}
+
+	if _, ok, _ := s.Load("missing"); ok {
+		t.Errorf("Load(missing) expected no checkpoint")
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	data := []struct {
+		uri string
+		err string
+	}{
+		{"file:///tmp/transporter-state-test", ""},
+		{"nothere:///blah", "checkpoint store not found in registry"},
+		{"/tmp/blah", "malformed checkpoint uri, expected scheme://location"},
+	}
+
+	for _, v := range data {
+		_, err := NewStore(v.uri)
+		if err != nil && err.Error() != v.err {
+			t.Errorf("expected error: %v\ngot error: %v\n", v.err, err.Error())
+		}
+		if err == nil && v.err != "" {
+			t.Errorf("expected error: %v, got none", v.err)
+		}
+	}
+
+	a, _ := NewStore("file:///tmp/transporter-state-test")
+	b, _ := NewStore("file:///tmp/transporter-state-test")
+	if a != b {
+		t.Errorf("expected the same store for the same uri")
+	}
+}
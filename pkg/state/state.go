@@ -0,0 +1,79 @@
+// Copyright 2014 The Transporter Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package state provides checkpoint stores, which let source adaptors record how far
+// through a stream they have gotten, so that a restarted transporter can resume
+// where it left off instead of starting again from scratch.
+package state
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrMissingStore is returned when the requested store type was not found in the registry
+	ErrMissingStore = errors.New("checkpoint store not found in registry")
+
+	// a registry of store types (uri schemes) and their constructors
+	registry = map[string]func(string) (Store, error){
+		"file": NewFileStore,
+	}
+
+	// stores that have already been opened, keyed by uri, so that nodes
+	// sharing a uri also share a store
+	stores   = map[string]Store{}
+	storesMu sync.Mutex
+)
+
+// DefaultURI is the store used when a node asks to resume, but doesn't name a store
+const DefaultURI = "file://transporter.state"
+
+// Store records the last checkpoint for each node.  Nodes are identified by their path in the pipeline.
+// Checkpoints are opaque int64 values, it's up to the adaptor to decide what they mean (a mongo oplog
+// timestamp, for instance)
+type Store interface {
+	// Save records the checkpoint for the given path
+	Save(path string, checkpoint int64) error
+
+	// Load returns the checkpoint for the given path, and whether one was found
+	Load(path string) (int64, bool, error)
+}
+
+// Register registers a checkpoint store for use with Transporter.
+// The name is the uri scheme that selects the store, and fn is a constructor
+// that is handed the remainder of the uri
+func Register(name string, fn func(string) (Store, error)) {
+	registry[name] = fn
+}
+
+// NewStore returns the Store described by the uri, i.e. file:///var/lib/transporter/state.
+// Stores are cached, so asking for the same uri twice returns the same Store
+func NewStore(uri string) (Store, error) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	if s, ok := stores[uri]; ok {
+		return s, nil
+	}
+
+	fields := strings.SplitN(uri, "://", 2)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("malformed checkpoint uri, expected scheme://location")
+	}
+
+	fn, ok := registry[fields[0]]
+	if !ok {
+		return nil, ErrMissingStore
+	}
+
+	s, err := fn(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	stores[uri] = s
+	return s, nil
+}